@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search"
+	"github.com/blevesearch/bleve/search/query"
+)
+
+// address headers parsed into keyword fields
+var addressHeaders = []string{"From", "To", "Cc"}
+
+// Address and Domain filters with this key match any address header
+const anyAddressHeader = "Any"
+
+// used when an address header is too malformed for mail.ParseAddressList
+var bareAddressRe = regexp.MustCompile(`[^\s<>@,;:"]+@[^\s<>@,;:"]+`)
+
+// addressFields holds the addresses of one header, lowercased for exact
+// matching
+type addressFields struct {
+	Address []string `json:",omitempty"`
+	Local   []string `json:",omitempty"`
+	Domain  []string `json:",omitempty"`
+	Name    []string `json:",omitempty"`
+}
+
+// messageAddresses holds the parsed address headers of a message
+type messageAddresses struct {
+	From addressFields
+	To   addressFields
+	Cc   addressFields
+}
+
+// DomainCount is the number of matching messages with an address in a domain
+type DomainCount struct {
+	Domain string
+	Count  int
+}
+
+// parseAddresses reads the address headers of a message
+func parseAddresses(header mail.Header) messageAddresses {
+	return messageAddresses{
+		From: parseAddressHeader(header, "From"),
+		To:   parseAddressHeader(header, "To"),
+		Cc:   parseAddressHeader(header, "Cc"),
+	}
+}
+
+func parseAddressHeader(header mail.Header, field string) addressFields {
+	var fields addressFields
+	list, err := header.AddressList(field)
+	if err != nil {
+		// salvage what looks like addresses
+		list = nil
+		for _, value := range header[field] {
+			for _, a := range bareAddressRe.FindAllString(value, -1) {
+				list = append(list, &mail.Address{Address: a})
+			}
+		}
+	}
+	for _, a := range list {
+		address := strings.ToLower(a.Address)
+		fields.Address = append(fields.Address, address)
+		if i := strings.LastIndex(address, "@"); i != -1 {
+			fields.Local = append(fields.Local, address[:i])
+			fields.Domain = append(fields.Domain, address[i+1:])
+		}
+		if a.Name != "" {
+			fields.Name = append(fields.Name, strings.ToLower(a.Name))
+		}
+	}
+	return fields
+}
+
+// addressQuery matches a keyword address field, e.g. Domain, of one address
+// header or, for anyAddressHeader, of any of them
+func addressQuery(header, field, value string) (query.Query, error) {
+	headers := []string{header}
+	if header == anyAddressHeader {
+		headers = addressHeaders
+	} else if !isAddressHeader(header) {
+		return nil, fmt.Errorf("invalid address header '%s'", header)
+	}
+
+	value = strings.ToLower(strings.TrimSpace(value))
+	queries := make([]query.Query, 0, len(headers))
+	for _, h := range headers {
+		q := query.NewTermQuery(value)
+		q.SetField("Addresses." + h + "." + field)
+		queries = append(queries, q)
+	}
+	if len(queries) == 1 {
+		return queries[0], nil
+	}
+	return query.NewDisjunctionQuery(queries), nil
+}
+
+func isAddressHeader(header string) bool {
+	for _, h := range addressHeaders {
+		if h == header {
+			return true
+		}
+	}
+	return false
+}
+
+// addDomainFacets asks a search for the most common domains of each address
+// header
+func addDomainFacets(bRequest *bleve.SearchRequest, size int) {
+	for _, h := range addressHeaders {
+		bRequest.AddFacet(h, bleve.NewFacetRequest("Addresses."+h+".Domain", size))
+	}
+}
+
+// domainCounts reads the results of addDomainFacets
+func domainCounts(facets search.FacetResults) map[string][]DomainCount {
+	counts := make(map[string][]DomainCount)
+	for _, h := range addressHeaders {
+		facet, ok := facets[h]
+		if !ok {
+			continue
+		}
+		domains := make([]DomainCount, 0, len(facet.Terms))
+		for _, term := range facet.Terms {
+			domains = append(domains, DomainCount{Domain: term.Term, Count: term.Count})
+		}
+		counts[h] = domains
+	}
+	return counts
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/mail"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const addressStr = `From: "Bob Smith" <Bob@Example.COM>
+To: alice@example.org, "Carol" <carol@sub.example.org>
+Cc: undisclosed-recipients:;
+Subject: addresses
+Date: Mon, 2 Jan 2006 15:04:05 -0700
+
+zxq8token
+`
+
+const lookalikeStr = `From: bobb@example.com
+To: alice@example.org.evil.com
+Subject: lookalike
+Date: Mon, 2 Jan 2006 15:04:05 -0700
+
+zxq8token
+`
+
+func TestParseAddresses(t *testing.T) {
+	msg, err := mail.ReadMessage(strings.NewReader(addressStr))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	addresses := parseAddresses(msg.Header)
+
+	from := addressFields{
+		Address: []string{"bob@example.com"},
+		Local:   []string{"bob"},
+		Domain:  []string{"example.com"},
+		Name:    []string{"bob smith"},
+	}
+	if !reflect.DeepEqual(addresses.From, from) {
+		t.Errorf("expected From %+v, got %+v", from, addresses.From)
+	}
+	if domains := []string{"example.org", "sub.example.org"}; !reflect.DeepEqual(addresses.To.Domain, domains) {
+		t.Errorf("expected To domains %v, got %v", domains, addresses.To.Domain)
+	}
+	if len(addresses.Cc.Address) != 0 {
+		t.Errorf("expected no Cc addresses, got %v", addresses.Cc.Address)
+	}
+
+	// unparseable headers still yield their addresses
+	header := mail.Header{"To": []string{"<broken@example.net"}}
+	if got := parseAddresses(header).To.Address; !reflect.DeepEqual(got, []string{"broken@example.net"}) {
+		t.Errorf("expected salvaged address, got %v", got)
+	}
+}
+
+func TestSearchAddresses(t *testing.T) {
+	defer purge("address@example.com")
+	for _, data := range []string{addressStr, lookalikeStr} {
+		if err := handleMessage(nil, "from@example.com", []string{"address@example.com"}, []byte(data)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	tests := []struct {
+		request SearchRequest
+		count   int
+	}{
+		{SearchRequest{Address: map[string]string{"From": "BOB@example.com"}}, 1},
+		{SearchRequest{Address: map[string]string{"To": "bob@example.com"}}, 0},
+		{SearchRequest{Address: map[string]string{"Any": "carol@sub.example.org"}}, 1},
+		{SearchRequest{Domain: map[string]string{"From": "example.com"}}, 2},
+		{SearchRequest{Domain: map[string]string{"To": "example.org"}}, 1},
+		{SearchRequest{Domain: map[string]string{"Any": "evil.com"}}, 0},
+	}
+	for _, test := range tests {
+		test.request.Query = "zxq8token"
+		test.request.Locations = []string{bodyLocation}
+		bQuery, err := buildQuery(test.request)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		docs, err := matchingDocs(bQuery)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(docs) != test.count {
+			t.Errorf("expected %d results for %+v, got %d", test.count, test.request, len(docs))
+		}
+	}
+
+	if _, err := buildQuery(SearchRequest{Address: map[string]string{"Bcc": "bob@example.com"}}); err == nil {
+		t.Error("expected an error for an invalid address header")
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// prefix of the versioned API
+const apiV1 = "/api/v1"
+
+type ListHandler struct{}
+type MessageHandler struct{}
+
+// APIError is the body of every error response from the versioned API
+type APIError struct {
+	Status int
+	Error  string
+}
+
+// registerAPIv1 adds the versioned API. Requests with side effects use POST,
+// PATCH or DELETE, and errors are returned as APIError.
+func registerAPIv1(router *mux.Router) {
+	routes := []struct {
+		path    string
+		handler http.Handler
+		methods []string
+	}{
+		{"/messages", &ListHandler{}, []string{"GET"}},
+		{"/messages", &PurgeHandler{}, []string{"DELETE"}},
+		{"/messages/{docID}", &MessageHandler{}, []string{"GET"}},
+		{"/messages/{docID}", &StateHandler{}, []string{"PATCH"}},
+		{"/messages/{docID}", &DeleteHandler{}, []string{"DELETE"}},
+		{"/messages/{docID}/release", &MailHandler{}, []string{"POST"}},
+		{"/messages/{docID}/raw", &RawHandler{}, []string{"GET"}},
+		{"/messages/{docID}/parts/{path}", &PartHandler{}, []string{"GET"}},
+		{"/messages/{docID}/attachments/{attachment}", &AttachmentHandler{}, []string{"GET"}},
+		{"/messages/{docID}/dkim", &DKIMHandler{}, []string{"GET"}},
+		{"/messages/{docID}/history", &HistoryHandler{}, []string{"GET"}},
+		{"/messages/{docID}/notes", &NotesHandler{}, []string{"GET", "POST"}},
+		{"/search", &SearchHandler{}, []string{"POST"}},
+		{"/threads/{threadID}", &ThreadHandler{}, []string{"GET"}},
+		{"/duplicates", &DuplicatesHandler{}, []string{"GET"}},
+		{"/bulk/{action}", &BulkHandler{}, []string{"POST"}},
+		{"/delete", &DeleteQueryHandler{}, []string{"POST"}},
+		{"/queue", &QueueHandler{}, []string{"GET"}},
+		{"/export", &ExportHandler{}, []string{"POST"}},
+		{"/import", &ImportHandler{}, []string{"POST"}},
+		{"/backup", &BackupHandler{}, []string{"GET"}},
+	}
+	for _, route := range routes {
+		router.Handle(apiV1+route.path, jsonErrors(route.handler)).Methods(route.methods...)
+	}
+}
+
+// deprecated marks responses from the unversioned API, which is kept for
+// existing clients, as superseded by apiV1
+func deprecated(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", apiV1))
+		h.ServeHTTP(w, req)
+	})
+}
+
+// writeError writes an APIError
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	mustEncode(w, APIError{Status: status, Error: message})
+}
+
+// jsonErrors turns the plain text errors written by http.Error into
+// APIError bodies, so handlers can be shared with the unversioned API
+func jsonErrors(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ew := &errorWriter{ResponseWriter: w}
+		h.ServeHTTP(ew, req)
+		if ew.status != 0 {
+			w.Header().Del("X-Content-Type-Options")
+			writeError(w, ew.status, strings.TrimSpace(ew.buf.String()))
+		}
+	})
+}
+
+// errorWriter holds back plain text error responses
+type errorWriter struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+func (e *errorWriter) WriteHeader(status int) {
+	if status >= 400 && strings.HasPrefix(e.Header().Get("Content-Type"), "text/plain") {
+		e.status = status
+		return
+	}
+	e.ResponseWriter.WriteHeader(status)
+}
+
+func (e *errorWriter) Write(b []byte) (int, error) {
+	if e.status != 0 {
+		return e.buf.Write(b)
+	}
+	return e.ResponseWriter.Write(b)
+}
+
+// ListHandler searches messages with the query parameters read by
+// queryRequest
+func (h *ListHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	searchRequest, err := queryRequest(req.URL.Query())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), 400)
+		return
+	}
+
+	result, httpStatus, err := searchMessages(searchRequest)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), httpStatus)
+		return
+	}
+	mustEncode(w, result)
+}
+
+// queryRequest reads a SearchRequest from query parameters. Fields are named
+// in lower case, with underscores between words e.g. has_attachment. Map
+// fields take the key after a dot e.g. auth.SPF=pass. Repeated parameters
+// give list fields several values.
+func queryRequest(values url.Values) (SearchRequest, error) {
+	var r SearchRequest
+	var err error
+	for name, vs := range values {
+		v := vs[len(vs)-1]
+		if i := strings.Index(name, "."); i != -1 {
+			field, key := name[:i], name[i+1:]
+			var m *map[string]string
+			switch field {
+			case "auth":
+				m = &r.Auth
+			case "history":
+				m = &r.History
+			case "address":
+				m = &r.Address
+			case "domain":
+				m = &r.Domain
+			default:
+				return r, fmt.Errorf("unknown parameter '%s'", name)
+			}
+			if *m == nil {
+				*m = make(map[string]string)
+			}
+			(*m)[key] = v
+			continue
+		}
+
+		switch name {
+		case "q":
+			r.Query = v
+		case "location":
+			r.Locations = vs
+		case "tag":
+			r.Tags = vs
+		case "label":
+			r.Labels = vs
+		case "filename":
+			r.Filename = v
+		case "content_type":
+			r.ContentType = v
+		case "duplicate_of":
+			r.DuplicateOf = v
+		case "fingerprint":
+			r.Fingerprint = v
+		case "note_author":
+			r.NoteAuthor = v
+		case "limit":
+			r.Limit, err = strconv.Atoi(v)
+		case "offset":
+			r.Offset, err = strconv.Atoi(v)
+		case "domain_facets":
+			r.DomainFacets, err = strconv.Atoi(v)
+		case "start":
+			r.StartTime, err = time.Parse(time.RFC3339, v)
+		case "end":
+			r.EndTime, err = time.Parse(time.RFC3339, v)
+		case "threaded":
+			r.Threaded, err = strconv.ParseBool(v)
+		case "seen":
+			r.Seen, err = boolParam(v)
+		case "starred":
+			r.Starred, err = boolParam(v)
+		case "has_attachment":
+			r.HasAttachment, err = boolParam(v)
+		case "duplicate":
+			r.Duplicate, err = boolParam(v)
+		default:
+			return r, fmt.Errorf("unknown parameter '%s'", name)
+		}
+		if err != nil {
+			return r, fmt.Errorf("invalid parameter '%s': %s", name, err)
+		}
+	}
+	return r, nil
+}
+
+func boolParam(v string) (*bool, error) {
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// MessageHandler returns a single message with its body, attachments and
+// notes
+func (h *MessageHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	docID := mux.Vars(req)["docID"]
+
+	result, err := searchDoc(docID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), 500)
+		return
+	}
+	if len(result.Emails) == 0 {
+		http.Error(w, fmt.Sprintf("mail with ID %s not found", docID), 404)
+		return
+	}
+	mustEncode(w, result.Emails[0])
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestAPIv1(t *testing.T) {
+	defer purge("api@example.com")
+	router := mux.NewRouter()
+	registerAPIv1(router)
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	apiError := func(w *httptest.ResponseRecorder, status int) {
+		if w.Code != status {
+			t.Errorf("expected status %d, got %d: %s", status, w.Code, w.Body.String())
+			return
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("expected a JSON error, got Content-Type '%s'", ct)
+		}
+		var e APIError
+		if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if e.Status != status || e.Error == "" {
+			t.Errorf("unexpected error body %+v", e)
+		}
+	}
+
+	if err := handleMessage(nil, "from@example.com", []string{"api@example.com"}, []byte(noteEmailStr)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	w := do("GET", "/api/v1/messages?address.To=to@example.com&tag=none&limit=5", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	w = do("GET", "/api/v1/messages?q=needs+review&location=Subject&limit=5", "")
+	var result SearchResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var id string
+	for _, e := range result.Emails {
+		if e.Header.Get("Subject") == "needs review" {
+			id = e.ID
+		}
+	}
+	if id == "" {
+		t.Fatalf("expected the message in %s", w.Body.String())
+	}
+
+	w = do("PATCH", "/api/v1/messages/"+id, `{"Seen": true, "AddLabels": ["api"]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	w = do("GET", "/api/v1/messages/"+id, "")
+	var email Email
+	if err := json.Unmarshal(w.Body.Bytes(), &email); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if email.ID != id || !email.Seen || len(email.Labels) != 1 {
+		t.Errorf("unexpected message %+v", email)
+	}
+
+	// releasing has side effects, so needs POST
+	if w = do("GET", "/api/v1/messages/"+id+"/release", ""); w.Code == http.StatusOK {
+		t.Error("expected GET of the release route to fail")
+	}
+
+	apiError(do("GET", "/api/v1/messages/missing", ""), http.StatusNotFound)
+	apiError(do("GET", "/api/v1/messages?limit=many", ""), http.StatusBadRequest)
+	apiError(do("GET", "/api/v1/messages?bogus=1", ""), http.StatusBadRequest)
+	apiError(do("PATCH", "/api/v1/messages/"+id, `{"AddLabels": [""]}`), http.StatusBadRequest)
+	apiError(do("POST", "/api/v1/search", `{"Query": "ab"}`), http.StatusBadRequest)
+
+	if w = do("DELETE", "/api/v1/messages/"+id, ""); w.Code != http.StatusOK {
+		t.Errorf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	apiError(do("DELETE", "/api/v1/messages/"+id, ""), http.StatusNotFound)
+}
+
+func TestQueryRequest(t *testing.T) {
+	values, _ := url.ParseQuery("q=invoice&location=Subject&location=Body&tag=a&tag=b&seen=false&auth.SPF=pass&domain.Any=example.com&start=2017-04-04T00:00:00Z&threaded=1")
+	r, err := queryRequest(values)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if r.Query != "invoice" || len(r.Locations) != 2 || len(r.Tags) != 2 || r.Seen == nil || *r.Seen ||
+		r.Auth["SPF"] != "pass" || r.Domain["Any"] != "example.com" || r.StartTime.IsZero() || !r.Threaded {
+		t.Errorf("unexpected request %+v", r)
+	}
+
+	for _, q := range []string{"seen=maybe", "start=yesterday", "other.Key=1"} {
+		values, _ := url.ParseQuery(q)
+		if _, err := queryRequest(values); err == nil {
+			t.Errorf("expected an error for %s", q)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// prefix of the index internal keys holding release history
+const historyKeyPrefix = "history/"
+
+// header used to identify the user when icemail sits behind an
+// authenticating proxy
+const remoteUserHeader = "X-Remote-User"
+
+// historyMu serialises appends to the release history
+var historyMu sync.Mutex
+
+type HistoryHandler struct{}
+
+type HistoryResult struct {
+	ID     string
+	Events []releaseEvent
+}
+
+// releaseEvent records one attempt to deliver a message
+type releaseEvent struct {
+	Time time.Time
+	// HTTP user, or the whitelist entry which auto-released the message
+	Actor      string
+	RemoteAddr string `json:",omitempty"`
+	Recipients []string
+	// envelope sender after any return-path rewrite
+	ReturnPath string `json:",omitempty"`
+	// transport the message was handed to
+	Transport string
+	// reply from the transport, or the error on failure
+	Response string
+	Success  bool
+	// recipients the attempt didn't reach
+	Failed []string `json:",omitempty"`
+	// ID of the bounce generated for a permanent failure
+	DSN string `json:",omitempty"`
+}
+
+// releaseActor identifies who or what released a message
+type releaseActor struct {
+	Name       string
+	RemoteAddr string
+}
+
+// requestActor identifies the user behind an HTTP request
+func requestActor(req *http.Request) releaseActor {
+	actor := releaseActor{Name: "anonymous"}
+
+	actor.RemoteAddr = req.RemoteAddr
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		actor.RemoteAddr = host
+	}
+	if fwd := req.Header.Get("X-Forwarded-For"); fwd != "" {
+		actor.RemoteAddr = strings.TrimSpace(strings.Split(fwd, ",")[0])
+	}
+
+	if user, _, ok := req.BasicAuth(); ok && user != "" {
+		actor.Name = user
+	} else if user := req.Header.Get(remoteUserHeader); user != "" {
+		actor.Name = user
+	}
+	return actor
+}
+
+func historyKey(docID string) []byte {
+	return []byte(historyKeyPrefix + docID)
+}
+
+// loadHistory returns the release history of a message, oldest first
+func loadHistory(docID string) ([]releaseEvent, error) {
+	events := make([]releaseEvent, 0)
+	b, err := index.GetInternal(historyKey(docID))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return events, nil
+	}
+	if err = json.Unmarshal(b, &events); err != nil {
+		return nil, fmt.Errorf("error reading history of mail with ID %s: %s", docID, err)
+	}
+	return events, nil
+}
+
+// appendHistory adds an event to the history of a message. Existing events
+// are never modified.
+func appendHistory(docID string, event releaseEvent) ([]releaseEvent, error) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+
+	events, err := loadHistory(docID)
+	if err != nil {
+		return nil, err
+	}
+	events = append(events, event)
+	b, err := json.Marshal(events)
+	if err != nil {
+		return nil, err
+	}
+	if err = index.SetInternal(historyKey(docID), b); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// dropHistory removes the event most recently added by appendHistory, when the
+// state it describes couldn't be saved
+func dropHistory(docID string) error {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+
+	events, err := loadHistory(docID)
+	if err != nil || len(events) == 0 {
+		return err
+	}
+	events = events[:len(events)-1]
+	if len(events) == 0 {
+		return index.DeleteInternal(historyKey(docID))
+	}
+	b, err := json.Marshal(events)
+	if err != nil {
+		return err
+	}
+	return index.SetInternal(historyKey(docID), b)
+}
+
+func deleteHistory(docID string) error {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	return index.DeleteInternal(historyKey(docID))
+}
+
+func (h *HistoryHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	docID := mux.Vars(req)["docID"]
+
+	doc, err := index.Document(docID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), 500)
+		return
+	}
+	if doc == nil {
+		http.Error(w, fmt.Sprintf("mail with ID %s not found", docID), 404)
+		return
+	}
+
+	result := HistoryResult{ID: docID}
+	if result.Events, err = loadHistory(docID); err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), 500)
+		return
+	}
+
+	mustEncode(w, result)
+}
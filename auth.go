@@ -0,0 +1,688 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// authentication results, as used in Authentication-Results headers
+const (
+	authNone      = "none"
+	authPass      = "pass"
+	authFail      = "fail"
+	authNeutral   = "neutral"
+	authSoftFail  = "softfail"
+	authTempError = "temperror"
+	authPermError = "permerror"
+)
+
+// spfLookupLimit is the maximum number of DNS-querying terms evaluated for a
+// single SPF check (RFC 7208 section 4.6.4)
+const spfLookupLimit = 10
+
+// authResults holds the outcome of checking a message's DKIM signatures, the
+// SPF policy of the envelope sender, and any ARC chain
+type authResults struct {
+	DKIM string
+	// domains of the DKIM signatures which passed
+	DKIMDomains []string
+	SPF         string
+	ARC         string
+}
+
+var bTagRe = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+
+// verifyAuth runs all authentication checks on the raw message data.
+// clientIP and mailFrom are the connecting client's address and the SMTP
+// envelope sender.
+func verifyAuth(data []byte, clientIP net.IP, mailFrom string, r dnsResolver) authResults {
+	fields, body := splitMessage(data)
+
+	res := authResults{DKIM: authNone, DKIMDomains: make([]string, 0)}
+	for _, f := range fields {
+		if !strings.EqualFold(f.Name, "DKIM-Signature") {
+			continue
+		}
+		domain, result := verifyDKIMSignature(fields, body, f, r)
+		if result == authPass {
+			res.DKIMDomains = append(res.DKIMDomains, domain)
+			res.DKIM = authPass
+		} else if res.DKIM != authPass {
+			res.DKIM = result
+		}
+	}
+
+	res.SPF = checkSPF(clientIP, mailFrom, r)
+	res.ARC = verifyARC(fields, body, r)
+
+	return res
+}
+
+// dkimTags parses a DKIM tag=value list
+func dkimTags(value string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, t := range strings.Split(value, ";") {
+		t = strings.TrimSpace(t)
+		if t == "" {
+			continue
+		}
+		i := strings.Index(t, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("malformed tag '%s'", t)
+		}
+		name := strings.TrimSpace(t[:i])
+		if _, ok := tags[name]; ok {
+			return nil, fmt.Errorf("duplicate tag '%s'", name)
+		}
+		tags[name] = strings.TrimSpace(t[i+1:])
+	}
+	return tags, nil
+}
+
+// stripWSP removes all whitespace, as found in folded base64 tag values
+func stripWSP(s string) string {
+	return strings.Join(strings.Fields(s), "")
+}
+
+// verifyDKIMSignature checks a single DKIM-Signature field, returning the
+// signing domain and the result
+func verifyDKIMSignature(fields []headerField, body []byte, sig headerField, r dnsResolver) (string, string) {
+	tags, err := dkimTags(sig.Value)
+	if err != nil {
+		return "", authPermError
+	}
+	domain := tags["d"]
+	for _, required := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[required]; !ok {
+			return domain, authPermError
+		}
+	}
+	if tags["v"] != "1" {
+		return domain, authPermError
+	}
+
+	key, result := dkimPublicKey(tags["s"], domain, r)
+	if result != "" {
+		return domain, result
+	}
+
+	return domain, verifyDKIMTags(fields, body, sig, tags, key)
+}
+
+// verifyDKIMTags checks the body hash and signature described by already
+// parsed tags. It's shared by DKIM-Signature and ARC-Message-Signature.
+func verifyDKIMTags(fields []headerField, body []byte, sig headerField, tags map[string]string, key *rsa.PublicKey) string {
+	var hashType crypto.Hash
+	var newHash func() hash.Hash
+	switch tags["a"] {
+	case "rsa-sha256":
+		hashType, newHash = crypto.SHA256, sha256.New
+	case "rsa-sha1":
+		hashType, newHash = crypto.SHA1, sha1.New
+	default:
+		return authPermError
+	}
+
+	headerCanon, bodyCanon := "simple", "simple"
+	if c, ok := tags["c"]; ok {
+		parts := strings.SplitN(c, "/", 2)
+		headerCanon = parts[0]
+		if len(parts) == 2 {
+			bodyCanon = parts[1]
+		}
+	}
+
+	var canonBody []byte
+	switch bodyCanon {
+	case "simple":
+		canonBody = dkimCanonicalBodySimple(body)
+	case "relaxed":
+		canonBody = dkimCanonicalBodyRelaxed(body)
+	default:
+		return authPermError
+	}
+	if l, ok := tags["l"]; ok {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 || n > len(canonBody) {
+			return authPermError
+		}
+		canonBody = canonBody[:n]
+	}
+	bh := newHash()
+	bh.Write(canonBody)
+	if base64.StdEncoding.EncodeToString(bh.Sum(nil)) != stripWSP(tags["bh"]) {
+		return authFail
+	}
+
+	names := strings.Split(tags["h"], ":")
+	for i := range names {
+		names[i] = strings.TrimSpace(names[i])
+	}
+
+	// the signature field itself is included with the b= value emptied
+	unsigned := headerField{Name: sig.Name, Value: bTagRe.ReplaceAllString(sig.Value, "$1$2")}
+	h := newHash()
+	switch headerCanon {
+	case "simple":
+		h.Write(dkimCanonicalHeadersSimple(fields, names))
+		h.Write([]byte(strings.TrimSuffix(unsigned.Name+":"+unsigned.Value, "\r\n")))
+	case "relaxed":
+		h.Write(dkimCanonicalHeaders(fields, names))
+		h.Write([]byte(strings.TrimSuffix(dkimCanonicalHeaderRelaxed(unsigned), "\r\n")))
+	default:
+		return authPermError
+	}
+
+	b, err := base64.StdEncoding.DecodeString(stripWSP(tags["b"]))
+	if err != nil {
+		return authPermError
+	}
+	if err := rsa.VerifyPKCS1v15(key, hashType, h.Sum(nil), b); err != nil {
+		return authFail
+	}
+	return authPass
+}
+
+// dkimPublicKey fetches the key record for selector and domain. A non-empty
+// result is returned if the key couldn't be retrieved.
+func dkimPublicKey(selector, domain string, r dnsResolver) (*rsa.PublicKey, string) {
+	txts, err := r.LookupTXT(selector + "._domainkey." + domain)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, authPermError
+		}
+		return nil, authTempError
+	}
+	if len(txts) == 0 {
+		return nil, authPermError
+	}
+	tags, err := dkimTags(txts[0])
+	if err != nil {
+		return nil, authPermError
+	}
+	if k, ok := tags["k"]; ok && k != "rsa" {
+		return nil, authPermError
+	}
+	p := stripWSP(tags["p"])
+	if p == "" {
+		// empty key means it has been revoked
+		return nil, authFail
+	}
+	der, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, authPermError
+	}
+	if pub, err := x509.ParsePKIXPublicKey(der); err == nil {
+		if key, ok := pub.(*rsa.PublicKey); ok {
+			return key, ""
+		}
+		return nil, authPermError
+	}
+	key, err := x509.ParsePKCS1PublicKey(der)
+	if err != nil {
+		return nil, authPermError
+	}
+	return key, ""
+}
+
+func dkimCanonicalHeadersSimple(fields []headerField, names []string) []byte {
+	used := make(map[int]bool)
+	var b []byte
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(strings.TrimSpace(fields[i].Name), name) {
+				continue
+			}
+			used[i] = true
+			b = append(b, fields[i].Name+":"+fields[i].Value...)
+			break
+		}
+	}
+	return b
+}
+
+func dkimCanonicalBodySimple(body []byte) []byte {
+	s := string(body)
+	for strings.HasSuffix(s, "\r\n\r\n") {
+		s = strings.TrimSuffix(s, "\r\n")
+	}
+	if s == "" {
+		return []byte("\r\n")
+	}
+	if !strings.HasSuffix(s, "\r\n") {
+		s += "\r\n"
+	}
+	return []byte(s)
+}
+
+// checkSPF evaluates the SPF policy of the envelope sender's domain for the
+// client IP
+func checkSPF(ip net.IP, mailFrom string, r dnsResolver) string {
+	if ip == nil {
+		return authNone
+	}
+	domain := addressDomain(mailFrom)
+	if domain == "" {
+		return authNone
+	}
+	sender := mailFrom
+	if !strings.Contains(sender, "@") {
+		sender = "postmaster@" + domain
+	}
+	s := &spfCheck{ip: ip, sender: sender, r: r}
+	return s.check(domain)
+}
+
+type spfCheck struct {
+	ip      net.IP
+	sender  string
+	r       dnsResolver
+	lookups int
+}
+
+// spfRecord returns the single v=spf1 record for domain
+func (s *spfCheck) spfRecord(domain string) (string, string) {
+	txts, err := s.r.LookupTXT(domain)
+	if err != nil {
+		if isNotFound(err) {
+			return "", authNone
+		}
+		return "", authTempError
+	}
+	var record string
+	found := 0
+	for _, t := range txts {
+		if t == "v=spf1" || strings.HasPrefix(strings.ToLower(t), "v=spf1 ") {
+			record = t
+			found++
+		}
+	}
+	switch found {
+	case 0:
+		return "", authNone
+	case 1:
+		return record, ""
+	}
+	return "", authPermError
+}
+
+func (s *spfCheck) check(domain string) string {
+	record, result := s.spfRecord(domain)
+	if result != "" {
+		return result
+	}
+
+	var redirect string
+	for _, term := range strings.Fields(record)[1:] {
+		if i := strings.Index(term, "="); i > 0 && !strings.ContainsAny(term[:i], ":/") {
+			// modifier
+			if strings.EqualFold(term[:i], "redirect") {
+				redirect = term[i+1:]
+			}
+			continue
+		}
+
+		qualifier := authPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier, term = authFail, term[1:]
+		case '~':
+			qualifier, term = authSoftFail, term[1:]
+		case '?':
+			qualifier, term = authNeutral, term[1:]
+		}
+
+		match, result := s.mechanism(term, domain)
+		if result != "" {
+			return result
+		}
+		if match {
+			return qualifier
+		}
+	}
+
+	if redirect != "" {
+		target, err := s.expand(redirect, domain)
+		if err != nil {
+			return authPermError
+		}
+		if s.lookups++; s.lookups > spfLookupLimit {
+			return authPermError
+		}
+		result := s.check(target)
+		if result == authNone {
+			return authPermError
+		}
+		return result
+	}
+
+	return authNeutral
+}
+
+// mechanism evaluates a single SPF mechanism. A non-empty result means
+// evaluation must stop with that result.
+func (s *spfCheck) mechanism(term, domain string) (bool, string) {
+	name, arg := term, ""
+	if i := strings.IndexAny(term, ":/"); i >= 0 {
+		name, arg = term[:i], term[i:]
+	}
+	name = strings.ToLower(name)
+
+	switch name {
+	case "all":
+		return true, ""
+	case "ip4", "ip6":
+		if !strings.HasPrefix(arg, ":") {
+			return false, authPermError
+		}
+		cidr := arg[1:]
+		if !strings.Contains(cidr, "/") {
+			if name == "ip4" {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return false, authPermError
+		}
+		return network.Contains(s.ip), ""
+	}
+
+	if s.lookups++; s.lookups > spfLookupLimit {
+		return false, authPermError
+	}
+
+	target, v4mask, v6mask, err := s.domainSpec(arg, domain)
+	if err != nil {
+		return false, authPermError
+	}
+
+	switch name {
+	case "include":
+		if arg == "" {
+			return false, authPermError
+		}
+		switch s.check(target) {
+		case authPass:
+			return true, ""
+		case authFail, authSoftFail, authNeutral:
+			return false, ""
+		case authTempError:
+			return false, authTempError
+		default:
+			return false, authPermError
+		}
+	case "a":
+		return s.matchHost(target, v4mask, v6mask)
+	case "mx":
+		mxs, err := s.r.LookupMX(target)
+		if err != nil {
+			if isNotFound(err) {
+				return false, ""
+			}
+			return false, authTempError
+		}
+		for _, mx := range mxs {
+			if match, result := s.matchHost(mx.Host, v4mask, v6mask); match || result != "" {
+				return match, result
+			}
+		}
+		return false, ""
+	case "exists":
+		if arg == "" {
+			return false, authPermError
+		}
+		if _, err := s.r.LookupIP(target); err != nil {
+			if isNotFound(err) {
+				return false, ""
+			}
+			return false, authTempError
+		}
+		return true, ""
+	case "ptr":
+		// discouraged by RFC 7208 and not supported
+		return false, ""
+	}
+
+	return false, authPermError
+}
+
+func (s *spfCheck) matchHost(host string, v4mask, v6mask int) (bool, string) {
+	ips, err := s.r.LookupIP(host)
+	if err != nil {
+		if isNotFound(err) {
+			return false, ""
+		}
+		return false, authTempError
+	}
+	for _, ip := range ips {
+		bits, mask := 128, v6mask
+		if ip.To4() != nil {
+			ip, bits, mask = ip.To4(), 32, v4mask
+		}
+		if (s.ip.To4() != nil) != (bits == 32) {
+			continue
+		}
+		network := net.IPNet{IP: ip.Mask(net.CIDRMask(mask, bits)), Mask: net.CIDRMask(mask, bits)}
+		if network.Contains(s.ip) {
+			return true, ""
+		}
+	}
+	return false, ""
+}
+
+// domainSpec parses the optional ":domain" and "/cidr" suffixes of a mechanism
+func (s *spfCheck) domainSpec(arg, domain string) (string, int, int, error) {
+	v4mask, v6mask := 32, 128
+	target := domain
+	if strings.HasPrefix(arg, ":") {
+		arg = arg[1:]
+		spec := arg
+		if i := strings.Index(arg, "/"); i >= 0 {
+			spec, arg = arg[:i], arg[i:]
+		} else {
+			arg = ""
+		}
+		var err error
+		if target, err = s.expand(spec, domain); err != nil {
+			return "", 0, 0, err
+		}
+	}
+	if arg != "" {
+		parts := strings.Split(arg[1:], "//")
+		var err error
+		if parts[0] != "" {
+			if v4mask, err = strconv.Atoi(parts[0]); err != nil || v4mask > 32 {
+				return "", 0, 0, fmt.Errorf("invalid cidr '%s'", arg)
+			}
+		}
+		if len(parts) == 2 {
+			if v6mask, err = strconv.Atoi(parts[1]); err != nil || v6mask > 128 {
+				return "", 0, 0, fmt.Errorf("invalid cidr '%s'", arg)
+			}
+		}
+	}
+	return target, v4mask, v6mask, nil
+}
+
+// expand substitutes the basic SPF macros. Transformers and delimiters
+// aren't supported.
+func (s *spfCheck) expand(spec, domain string) (string, error) {
+	if !strings.Contains(spec, "%") {
+		return spec, nil
+	}
+	local := s.sender
+	if i := strings.LastIndex(local, "@"); i >= 0 {
+		local = local[:i]
+	}
+	macros := map[string]string{
+		"%{s}": s.sender,
+		"%{l}": local,
+		"%{o}": addressDomain(s.sender),
+		"%{d}": domain,
+		"%{i}": s.ip.String(),
+		"%%":   "%",
+		"%_":   " ",
+		"%-":   "%20",
+	}
+	for k, v := range macros {
+		spec = strings.Replace(spec, k, v, -1)
+		spec = strings.Replace(spec, strings.ToUpper(k), v, -1)
+	}
+	if strings.Contains(spec, "%") {
+		return "", fmt.Errorf("unsupported macro in '%s'", spec)
+	}
+	return spec, nil
+}
+
+// arcSet holds the three header fields of one ARC instance
+type arcSet struct {
+	seal, sig, results *headerField
+	sealTags, sigTags  map[string]string
+}
+
+// verifyARC validates the structure of the ARC chain, the most recent
+// ARC-Message-Signature and every ARC-Seal
+func verifyARC(fields []headerField, body []byte, r dnsResolver) string {
+	sets := make(map[int]*arcSet)
+	for i := range fields {
+		f := &fields[i]
+		name := strings.ToLower(strings.TrimSpace(f.Name))
+		if name != "arc-seal" && name != "arc-message-signature" && name != "arc-authentication-results" {
+			continue
+		}
+		var inst int
+		var tags map[string]string
+		var err error
+		if name == "arc-authentication-results" {
+			v := strings.TrimSpace(f.Value)
+			if !strings.HasPrefix(v, "i=") || !strings.Contains(v, ";") {
+				return authFail
+			}
+			inst, err = strconv.Atoi(strings.TrimSpace(v[2:strings.Index(v, ";")]))
+		} else {
+			if tags, err = dkimTags(f.Value); err != nil {
+				return authFail
+			}
+			inst, err = strconv.Atoi(tags["i"])
+		}
+		if err != nil || inst < 1 || inst > 50 {
+			return authFail
+		}
+		set, ok := sets[inst]
+		if !ok {
+			set = &arcSet{}
+			sets[inst] = set
+		}
+		switch name {
+		case "arc-seal":
+			if set.seal != nil {
+				return authFail
+			}
+			set.seal, set.sealTags = f, tags
+		case "arc-message-signature":
+			if set.sig != nil {
+				return authFail
+			}
+			set.sig, set.sigTags = f, tags
+		default:
+			if set.results != nil {
+				return authFail
+			}
+			set.results = f
+		}
+	}
+	if len(sets) == 0 {
+		return authNone
+	}
+
+	instances := make([]int, 0, len(sets))
+	for i := range sets {
+		instances = append(instances, i)
+	}
+	sort.Ints(instances)
+	for n, i := range instances {
+		set := sets[i]
+		if i != n+1 || set.seal == nil || set.sig == nil || set.results == nil {
+			return authFail
+		}
+		cv := set.sealTags["cv"]
+		if (i == 1 && cv != "none") || (i > 1 && cv != "pass") {
+			return authFail
+		}
+	}
+
+	// only the latest message signature needs to validate
+	latest := sets[len(instances)]
+	key, result := dkimPublicKey(latest.sigTags["s"], latest.sigTags["d"], r)
+	if result != "" {
+		return authFail
+	}
+	if verifyDKIMTags(fields, body, *latest.sig, latest.sigTags, key) != authPass {
+		return authFail
+	}
+
+	// each seal signs all ARC sets up to and including its own
+	for n := 1; n <= len(instances); n++ {
+		set := sets[n]
+		key, result := dkimPublicKey(set.sealTags["s"], set.sealTags["d"], r)
+		if result != "" {
+			return authFail
+		}
+		var b []byte
+		for i := 1; i <= n; i++ {
+			s := sets[i]
+			b = append(b, dkimCanonicalHeaderRelaxed(*s.results)...)
+			b = append(b, dkimCanonicalHeaderRelaxed(*s.sig)...)
+			if i < n {
+				b = append(b, dkimCanonicalHeaderRelaxed(*s.seal)...)
+			}
+		}
+		unsigned := headerField{Name: set.seal.Name, Value: bTagRe.ReplaceAllString(set.seal.Value, "$1$2")}
+		b = append(b, strings.TrimSuffix(dkimCanonicalHeaderRelaxed(unsigned), "\r\n")...)
+
+		if !verifyRSA(key, set.sealTags["a"], b, set.sealTags["b"]) {
+			return authFail
+		}
+	}
+
+	return authPass
+}
+
+func verifyRSA(key *rsa.PublicKey, algorithm string, data []byte, sig string) bool {
+	if algorithm != "rsa-sha256" {
+		return false
+	}
+	b, err := base64.StdEncoding.DecodeString(stripWSP(sig))
+	if err != nil {
+		return false
+	}
+	h := sha256.Sum256(data)
+	return rsa.VerifyPKCS1v15(key, crypto.SHA256, h[:], b) == nil
+}
+
+// originIP returns the IP address of an SMTP client
+func originIP(origin net.Addr) net.IP {
+	switch a := origin.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+	return nil
+}
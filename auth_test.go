@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const zoneStr = `$ORIGIN example.com.
+@	IN	TXT	"v=spf1 ip4:192.168.1.0/24 a:mail.example.com -all"
+mail	3600	IN	A	10.0.0.1
+test._domainkey	IN	TXT	( "v=DKIM1; k=rsa; "
+	"p=%s" )
+`
+
+// testKey returns a signing key, and a resolver serving example.com with
+// its public key as selector "test"
+func testKey(t *testing.T) (*rsa.PrivateKey, dnsResolver) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	dir, err := ioutil.TempDir("", appName)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	zoneFile := filepath.Join(dir, "example.com.zone")
+	zone := []byte(fmt.Sprintf(zoneStr, base64.StdEncoding.EncodeToString(der)))
+	if err := ioutil.WriteFile(zoneFile, zone, 0600); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	r, err := loadZoneFile(zoneFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return key, r
+}
+
+func TestVerifyAuth(t *testing.T) {
+	key, r := testKey(t)
+
+	signer := &dkimSigner{Domain: "example.com", Selector: "test", key: key}
+	sig, err := signer.Sign([]byte(emailStr))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	signed := []byte(sig + emailStr)
+
+	tests := []struct {
+		ip   string
+		data []byte
+		dkim string
+		spf  string
+	}{
+		{"192.168.1.1", signed, authPass, authPass},
+		{"10.0.0.1", signed, authPass, authPass},
+		{"10.0.0.2", signed, authPass, authFail},
+		{"192.168.1.1", []byte(emailStr), authNone, authPass},
+		{"192.168.1.1", append(signed, "tampered"...), authFail, authPass},
+	}
+	for i, test := range tests {
+		res := verifyAuth(test.data, net.ParseIP(test.ip), "from@example.com", r)
+		if res.DKIM != test.dkim {
+			t.Errorf("test %d: expected DKIM result '%s', got '%s'", i, test.dkim, res.DKIM)
+		}
+		if res.SPF != test.spf {
+			t.Errorf("test %d: expected SPF result '%s', got '%s'", i, test.spf, res.SPF)
+		}
+		if res.ARC != authNone {
+			t.Errorf("test %d: expected ARC result '%s', got '%s'", i, authNone, res.ARC)
+		}
+	}
+}
+
+// arcSeal adds ARC set i to a message: results, a message signature over
+// From, To and Subject, and a seal over every set so far
+func arcSeal(t *testing.T, key *rsa.PrivateKey, data []byte, i int) []byte {
+	fields, body := splitMessage(data)
+	sign := func(b []byte) string {
+		h := sha256.Sum256(b)
+		sig, err := rsa.SignPKCS1v15(nil, key, crypto.SHA256, h[:])
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return base64.StdEncoding.EncodeToString(sig)
+	}
+	relaxed := func(f headerField) string {
+		return strings.TrimSuffix(dkimCanonicalHeaderRelaxed(f), "\r\n")
+	}
+
+	results := headerField{"ARC-Authentication-Results", fmt.Sprintf(" i=%d; example.com; spf=pass\r\n", i)}
+
+	bodyHash := sha256.Sum256(dkimCanonicalBodyRelaxed(body))
+	sigValue := fmt.Sprintf(" i=%d; a=rsa-sha256; c=relaxed/relaxed; d=example.com; s=test;\r\n\th=from:to:subject; bh=%s;\r\n\tb=",
+		i, base64.StdEncoding.EncodeToString(bodyHash[:]))
+	signed := append(dkimCanonicalHeaders(fields, []string{"from", "to", "subject"}), relaxed(headerField{"ARC-Message-Signature", sigValue})...)
+	sig := headerField{"ARC-Message-Signature", sigValue + sign(signed) + "\r\n"}
+
+	// earlier sets, oldest first
+	var sealed []byte
+	for n := 1; n < i; n++ {
+		for _, name := range []string{"ARC-Authentication-Results", "ARC-Message-Signature", "ARC-Seal"} {
+			for _, f := range fields {
+				if strings.EqualFold(f.Name, name) && strings.Contains(f.Value, fmt.Sprintf("i=%d;", n)) {
+					sealed = append(sealed, dkimCanonicalHeaderRelaxed(f)...)
+				}
+			}
+		}
+	}
+	cv := "pass"
+	if i == 1 {
+		cv = "none"
+	}
+	sealValue := fmt.Sprintf(" i=%d; a=rsa-sha256; cv=%s; d=example.com; s=test;\r\n\tb=", i, cv)
+	sealed = append(sealed, dkimCanonicalHeaderRelaxed(results)...)
+	sealed = append(sealed, dkimCanonicalHeaderRelaxed(sig)...)
+	sealed = append(sealed, relaxed(headerField{"ARC-Seal", sealValue})...)
+
+	set := "ARC-Seal:" + sealValue + sign(sealed) + "\r\n" + sig.Name + ":" + sig.Value + results.Name + ":" + results.Value
+	return append([]byte(set), data...)
+}
+
+func TestVerifyARC(t *testing.T) {
+	key, r := testKey(t)
+
+	once := arcSeal(t, key, []byte(emailStr), 1)
+	twice := arcSeal(t, key, once, 2)
+
+	tests := []struct {
+		name string
+		data []byte
+		arc  string
+	}{
+		{"no chain", []byte(emailStr), authNone},
+		{"one set", once, authPass},
+		{"two sets", twice, authPass},
+		{"body changed", append(append([]byte(nil), twice...), " tampered"...), authFail},
+		{"sealed results changed", bytes.Replace(twice, []byte("i=1; example.com; spf=pass"), []byte("i=1; example.com; spf=fail"), 1), authFail},
+		{"set missing", bytes.Replace(once, []byte("i=1; example.com"), []byte("i=2; example.com"), 1), authFail},
+	}
+	for _, test := range tests {
+		if res := verifyAuth(test.data, net.ParseIP("192.168.1.1"), "from@example.com", r); res.ARC != test.arc {
+			t.Errorf("%s: expected ARC result '%s', got '%s'", test.name, test.arc, res.ARC)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve"
+)
+
+// first entry of a backup archive
+const backupManifestName = "manifest.json"
+
+type BackupHandler struct{}
+
+// backupManifest identifies a backup archive
+type backupManifest struct {
+	App           string
+	SchemaVersion int
+	Created       time.Time
+}
+
+// BackupHandler streams a backup of every message while icemail carries on
+// receiving mail
+func (h *BackupHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", backupFilename()))
+	// the response has started, so errors can only be logged
+	if _, err := writeBackup(w); err != nil {
+		log.Printf("Error writing backup: %s\n", err)
+	}
+}
+
+func backupFilename() string {
+	return fmt.Sprintf("%s-backup-%s.tar.gz", appName, time.Now().Format("20060102-150405"))
+}
+
+// writeBackup writes a gzipped tar archive of the messages in the index when
+// it is called, returning the number written. Each message's raw data,
+// document and internal data (such as its history) are read together, so
+// messages are consistent even if they change during the backup. Messages
+// deleted during the backup are left out.
+func writeBackup(w io.Writer) (int, error) {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	manifest, err := json.Marshal(backupManifest{App: appName, SchemaVersion: schemaVersion, Created: time.Now()})
+	if err != nil {
+		return 0, err
+	}
+	if err = writeTarEntry(tw, backupManifestName, manifest); err != nil {
+		return 0, err
+	}
+
+	docs, err := matchingDocs(bleve.NewMatchAllQuery())
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, d := range docs {
+		doc, httpStatus, err := getDoc(d.ID)
+		if httpStatus == 404 {
+			continue
+		}
+		if err != nil {
+			return count, fmt.Errorf("error loading mail ID %s: %s", d.ID, err)
+		}
+		raw, err := msgStore.Get(d.ID)
+		if err == errNotStored {
+			continue
+		}
+		if err != nil {
+			return count, fmt.Errorf("error retrieving mail ID %s: %s", d.ID, err)
+		}
+		// derived from the raw message on restore
+		doc.Body = ""
+		b, err := json.Marshal(doc)
+		if err != nil {
+			return count, err
+		}
+
+		if err = writeTarEntry(tw, "messages/"+d.ID+".eml", raw); err != nil {
+			return count, err
+		}
+		if err = writeTarEntry(tw, "messages/"+d.ID+".json", b); err != nil {
+			return count, err
+		}
+		for _, prefix := range docInternalPrefixes {
+			key := prefix + d.ID
+			v, err := index.GetInternal([]byte(key))
+			if err != nil {
+				return count, err
+			}
+			if len(v) > 0 {
+				if err = writeTarEntry(tw, "internal/"+key, v); err != nil {
+					return count, err
+				}
+			}
+		}
+		count++
+	}
+
+	if err = tw.Close(); err != nil {
+		return count, err
+	}
+	return count, gz.Close()
+}
+
+func writeTarEntry(tw *tar.Writer, name string, data []byte) error {
+	hdr := &tar.Header{Name: name, Mode: 0600, Size: int64(len(data)), ModTime: time.Now()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// restoreBackup reads a backup archive into a new index and message store,
+// returning the number of messages restored. The archive is rejected if it
+// wasn't written by icemail or was written by a newer schema.
+func restoreBackup(r io.Reader, newIndex bleve.Index, newStore messageStore) (int, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, fmt.Errorf("not a backup archive: %s", err)
+	}
+	tr := tar.NewReader(gz)
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != backupManifestName {
+		return 0, fmt.Errorf("not a backup archive: missing %s", backupManifestName)
+	}
+	var manifest backupManifest
+	if err = json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return 0, fmt.Errorf("error reading %s: %s", backupManifestName, err)
+	}
+	if manifest.App != appName {
+		return 0, fmt.Errorf("not a backup archive: written by '%s'", manifest.App)
+	}
+	if manifest.SchemaVersion > schemaVersion {
+		return 0, fmt.Errorf("backup schema version %d is newer than this version of %s supports (%d)", manifest.SchemaVersion, appName, schemaVersion)
+	}
+
+	count := 0
+	batch := newIndex.NewBatch()
+	for {
+		hdr, err = tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return count, fmt.Errorf("error reading backup: %s", err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return count, fmt.Errorf("error reading backup: %s", err)
+		}
+
+		dir, name := path.Split(hdr.Name)
+		ext := path.Ext(name)
+		id := strings.TrimSuffix(name, ext)
+		switch {
+		case dir == "messages/" && ext == ".eml":
+			if err = newStore.Put(id, data); err != nil {
+				return count, err
+			}
+		case dir == "messages/" && ext == ".json":
+			var doc bleveDoc
+			if err = json.Unmarshal(data, &doc); err != nil {
+				return count, fmt.Errorf("error reading %s: %s", hdr.Name, err)
+			}
+			raw, err := newStore.Get(id)
+			if err != nil {
+				return count, fmt.Errorf("backup is missing the message for %s", hdr.Name)
+			}
+			msg, err := mail.ReadMessage(bytes.NewReader(raw))
+			if err != nil {
+				return count, fmt.Errorf("error parsing mail ID %s: %s", id, err)
+			}
+			doc.Type = "message"
+			doc.setContent(msg)
+			if err = batch.Index(id, doc); err != nil {
+				return count, err
+			}
+			count++
+		case strings.HasPrefix(hdr.Name, "internal/"):
+			batch.SetInternal([]byte(strings.TrimPrefix(hdr.Name, "internal/")), data)
+		default:
+			return count, fmt.Errorf("unexpected entry '%s' in backup", hdr.Name)
+		}
+
+		if batch.Size() >= bulkPageSize {
+			if err = newIndex.Batch(batch); err != nil {
+				return count, err
+			}
+			batch = newIndex.NewBatch()
+		}
+	}
+	if err = newIndex.Batch(batch); err != nil {
+		return count, err
+	}
+	return count, nil
+}
+
+// backupCommand saves a backup to the file given as the argument. A running
+// icemail is asked for the backup over HTTP. Otherwise the storage is read
+// directly.
+func backupCommand(indexDir string) error {
+	if flag.NArg() != 1 {
+		return fmt.Errorf("usage: %s backup -c config.toml file.tar.gz", appName)
+	}
+	path := flag.Arg(0)
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	var count int
+	err = fetchBackup(f)
+	if opErr, ok := err.(*net.OpError); ok && opErr.Op == "dial" {
+		// icemail isn't running
+		if config.Storage == memoryStorage {
+			f.Close()
+			os.Remove(path)
+			return fmt.Errorf("%s isn't running, and memory storage only exists while it is", appName)
+		}
+		if err = openStorage(indexDir); err != nil {
+			f.Close()
+			return err
+		}
+		count, err = writeBackup(f)
+		closeStorage()
+		if err == nil {
+			fmt.Printf("Backed up %d messages\n", count)
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("error writing backup: %s", err)
+	}
+	fmt.Printf("Wrote backup to '%s'\n", path)
+	return nil
+}
+
+// fetchBackup downloads a backup from the running icemail
+func fetchBackup(w io.Writer) error {
+	resp, err := http.Get("http://" + localHTTPAddr() + apiV1 + "/backup")
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			return urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("backup request failed: %s", resp.Status)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// localHTTPAddr returns the address at which a running icemail serves HTTP
+func localHTTPAddr() string {
+	if strings.HasPrefix(config.HTTPBindAddr, ":") {
+		return "localhost" + config.HTTPBindAddr
+	}
+	return config.HTTPBindAddr
+}
+
+// restoreCommand replaces the index and message store with the contents of
+// the backup given as the argument. icemail must not be running.
+func restoreCommand(indexDir string) error {
+	if flag.NArg() != 1 {
+		return fmt.Errorf("usage: %s restore -c config.toml file.tar.gz", appName)
+	}
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	storeFile, err := storePath(config.Storage, storeDir())
+	if err != nil {
+		return err
+	}
+	// not every store is locked while icemail is running, so check whether
+	// its HTTP server answers
+	if conn, err := net.DialTimeout("tcp", localHTTPAddr(), time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is running at %s, stop it before restoring", appName, localHTTPAddr())
+	}
+
+	tmpDir := filepath.Join(storeDir(), appName+".restore")
+	if err = os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(tmpDir, 0700); err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	newStore, err := openStore(config.Storage, tmpDir)
+	if err != nil {
+		return err
+	}
+	newIndexDir := filepath.Join(tmpDir, appName+".db")
+	newIndex, err := bleve.New(newIndexDir, buildIndexMapping())
+	if err != nil {
+		newStore.Close()
+		return err
+	}
+
+	count, err := restoreBackup(f, newIndex, newStore)
+	if err == nil {
+		err = setIndexSchema(newIndex, schemaVersion)
+	}
+	if err == nil {
+		err = newIndex.SetInternal(dataMigratedKey, []byte("1"))
+	}
+	newIndex.Close()
+	newStore.Close()
+	if err != nil {
+		return fmt.Errorf("error restoring '%s': %s", flag.Arg(0), err)
+	}
+
+	newStoreFile, _ := storePath(config.Storage, tmpDir)
+	if err = swapPaths([]string{storeFile, indexDir}, []string{newStoreFile, newIndexDir}); err != nil {
+		return err
+	}
+	fmt.Printf("Restored %d messages from '%s'\n", count, flag.Arg(0))
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blevesearch/bleve"
+)
+
+func TestBackupRestore(t *testing.T) {
+	// other tests search for this message's body
+	defer purge("backup@example.com")
+
+	if err := handleMessage(nil, "from@example.com", []string{"backup@example.com"}, []byte(multipartStr)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ids, err := exportIDs(SearchRequest{Query: "backup@example.com", Locations: []string{"To"}})
+	if err != nil || len(ids) == 0 {
+		t.Fatalf("backup message not found (%v)", err)
+	}
+	var id string
+	for _, i := range ids {
+		if doc, _, err := getDoc(i); err == nil && doc.Recipients[0] == "backup@example.com" {
+			id = i
+		}
+	}
+	if _, err = tagDoc(id, "backed-up"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err = appendHistory(id, releaseEvent{Actor: "test"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var buf bytes.Buffer
+	count, err := writeBackup(&buf)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	total, _ := index.DocCount()
+	if uint64(count) != total {
+		t.Errorf("expected %d messages backed up, got %d", total, count)
+	}
+
+	dir, err := ioutil.TempDir("", appName)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	newStore, err := openStore(fileStorage, dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	newIndex, err := bleve.NewMemOnly(buildIndexMapping())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	restored, err := restoreBackup(bytes.NewReader(buf.Bytes()), newIndex, newStore)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if restored != count {
+		t.Errorf("expected %d messages restored, got %d", count, restored)
+	}
+
+	savedIndex, savedStore := index, msgStore
+	index, msgStore = newIndex, newStore
+	doc, _, err := getDoc(id)
+	index, msgStore = savedIndex, savedStore
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(doc.Tags) != 1 || doc.Tags[0] != "backed-up" || len(doc.History) != 1 || doc.AttachmentCount != 1 {
+		t.Errorf("unexpected restored message %+v", doc)
+	}
+	if doc.Sender != "from@example.com" || doc.Received.IsZero() {
+		t.Errorf("expected envelope to be restored, got %+v", doc)
+	}
+}
+
+func TestRestoreValidation(t *testing.T) {
+	archive := func(manifest backupManifest) []byte {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+		b, _ := json.Marshal(manifest)
+		writeTarEntry(tw, backupManifestName, b)
+		tw.Close()
+		gz.Close()
+		return buf.Bytes()
+	}
+
+	tests := map[string][]byte{
+		"not gzip":     []byte("hello"),
+		"other app":    archive(backupManifest{App: "mailhog", SchemaVersion: schemaVersion}),
+		"newer schema": archive(backupManifest{App: appName, SchemaVersion: schemaVersion + 1, Created: time.Now()}),
+	}
+	for name, data := range tests {
+		newIndex, _ := bleve.NewMemOnly(buildIndexMapping())
+		if _, err := restoreBackup(bytes.NewReader(data), newIndex, nil); err == nil {
+			t.Errorf("%s: expected restore to fail", name)
+		}
+	}
+
+	newIndex, _ := bleve.NewMemOnly(buildIndexMapping())
+	if n, err := restoreBackup(bytes.NewReader(archive(backupManifest{App: appName, SchemaVersion: schemaVersion})), newIndex, nil); err != nil || n != 0 {
+		t.Errorf("expected empty backup to restore, got %d (%v)", n, err)
+	}
+	if !strings.HasSuffix(backupFilename(), ".tar.gz") {
+		t.Errorf("unexpected backup file name %s", backupFilename())
+	}
+}
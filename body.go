@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/base64"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strings"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// bodyLocation is the search location matching the decoded message text
+const bodyLocation = "Body"
+
+var (
+	htmlHiddenRe = regexp.MustCompile(`(?is)<(script|style|head)[^>]*>.*?</(script|style|head)\s*>`)
+	htmlBreakRe  = regexp.MustCompile(`(?i)<(br|/p|/div|/tr|/li|/h[1-6]|/td|/th)[^>]*>`)
+	htmlTagRe    = regexp.MustCompile(`(?s)<[^>]*>`)
+	blankLinesRe = regexp.MustCompile(`\n\s*\n+`)
+	spaceRunRe   = regexp.MustCompile(`[ \t\r\f\v]+`)
+)
+
+// attachment describes a MIME part which isn't part of the message text
+type attachment struct {
+	Filename    string
+	ContentType string
+	// decoded size in bytes
+	Size        int
+	ContentID   string `json:",omitempty"`
+	Disposition string
+}
+
+// messageContent is what icemail indexes from a message body
+type messageContent struct {
+	Text        string
+	Attachments []attachment
+}
+
+// parseContent walks the MIME tree of a message, decoding the text/plain and
+// text/html parts and describing the attachments
+func parseContent(msg *mail.Message) messageContent {
+	var content messageContent
+	var text []string
+	walkContent(textproto.MIMEHeader(msg.Header), msg.Body, &text, &content.Attachments, nil, 0)
+	content.Text = strings.Join(text, "\n")
+	return content
+}
+
+// walkContent collects the text and attachments of an entity, recursing into
+// multiparts. If data isn't nil the decoded attachments are collected too.
+func walkContent(header textproto.MIMEHeader, body io.Reader, text *[]string, attachments *[]attachment, data *[]entityData, depth int) {
+	// guard against pathologically nested messages
+	if depth > 10 {
+		return
+	}
+
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		// RFC 2045 default
+		mediaType, params = "text/plain", map[string]string{}
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err != nil {
+				return
+			}
+			// quoted-printable parts are already decoded by NextPart
+			walkContent(p.Header, p, text, attachments, data, depth+1)
+		}
+	}
+
+	disposition, dispParams, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	filename := dispParams["filename"]
+	if filename == "" {
+		filename = params["name"]
+	}
+	if dec, err := new(mime.WordDecoder).DecodeHeader(filename); err == nil {
+		filename = dec
+	}
+
+	isText := mediaType == "text/plain" || mediaType == "text/html"
+	if disposition == "attachment" || filename != "" || (!isText && mediaType != "message/rfc822") {
+		var size int64
+		if data != nil {
+			b, _ := ioutil.ReadAll(transferDecoder(header, body))
+			size = int64(len(b))
+			*data = append(*data, entityData{ContentType: header.Get("Content-Type"), Data: b})
+		} else {
+			size, _ = io.Copy(ioutil.Discard, transferDecoder(header, body))
+		}
+		if disposition == "" {
+			disposition = "inline"
+		}
+		*attachments = append(*attachments, attachment{
+			Filename:    filename,
+			ContentType: mediaType,
+			Size:        int(size),
+			ContentID:   strings.Trim(header.Get("Content-ID"), "<> "),
+			Disposition: disposition,
+		})
+		return
+	}
+
+	if mediaType == "message/rfc822" {
+		if msg, err := mail.ReadMessage(transferDecoder(header, body)); err == nil {
+			walkContent(textproto.MIMEHeader(msg.Header), msg.Body, text, attachments, data, depth+1)
+		}
+		return
+	}
+
+	b, err := ioutil.ReadAll(transferDecoder(header, body))
+	if err != nil && len(b) == 0 {
+		return
+	}
+	s := decodeCharset(b, params["charset"])
+	if mediaType == "text/html" {
+		s = htmlToText(s)
+	}
+	if s = strings.TrimSpace(s); s != "" {
+		*text = append(*text, s)
+	}
+}
+
+// setContent sets the fields derived from a message: its Message-ID,
+// references, addresses, text and attachments. msg.Body is consumed.
+func (doc *bleveDoc) setContent(msg *mail.Message) {
+	doc.MessageID = messageID(msg.Header)
+	doc.References = messageReferences(msg.Header)
+	doc.ThreadSubject, _ = threadSubject(msg.Header.Get("Subject"))
+	doc.Addresses = parseAddresses(msg.Header)
+	content := parseContent(msg)
+	doc.Body = content.Text
+	doc.Attachments = content.Attachments
+	doc.AttachmentCount = len(content.Attachments)
+	doc.AttachmentSize = 0
+	for _, a := range content.Attachments {
+		doc.AttachmentSize += a.Size
+	}
+}
+
+// messageID returns the Message-ID of a message without its angle brackets
+func messageID(header mail.Header) string {
+	return strings.Trim(strings.TrimSpace(header.Get("Message-ID")), "<>")
+}
+
+// transferDecoder undoes the Content-Transfer-Encoding of an entity
+func transferDecoder(header textproto.MIMEHeader, body io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(header.Get("Content-Transfer-Encoding"))) {
+	case "quoted-printable":
+		return quotedprintable.NewReader(body)
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &base64Cleaner{r: body})
+	}
+	return body
+}
+
+// base64Cleaner drops the line breaks and other whitespace base64 decoding
+// doesn't tolerate
+type base64Cleaner struct {
+	r io.Reader
+}
+
+func (c *base64Cleaner) Read(p []byte) (int, error) {
+	for {
+		n, err := c.r.Read(p)
+		j := 0
+		for _, b := range p[:n] {
+			switch b {
+			case '\r', '\n', ' ', '\t':
+			default:
+				p[j] = b
+				j++
+			}
+		}
+		if j > 0 || err != nil {
+			return j, err
+		}
+	}
+}
+
+// decodeCharset converts text in the given charset to UTF-8, using the
+// charset names and aliases browsers recognise. Text in unknown charsets is
+// returned unchanged.
+func decodeCharset(b []byte, charset string) string {
+	charset = strings.TrimSpace(charset)
+	if charset == "" {
+		return string(b)
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return string(b)
+	}
+	decoded, err := enc.NewDecoder().Bytes(b)
+	if err != nil {
+		return string(b)
+	}
+	return string(decoded)
+}
+
+// htmlToText strips markup from HTML, keeping line breaks at block elements
+func htmlToText(s string) string {
+	s = htmlHiddenRe.ReplaceAllString(s, "")
+	s = htmlBreakRe.ReplaceAllString(s, "\n")
+	s = htmlTagRe.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+	s = spaceRunRe.ReplaceAllString(s, " ")
+	s = blankLinesRe.ReplaceAllString(s, "\n\n")
+	return s
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+const multipartStr = "Date: Tue, 04 Apr 2017 19:02:05 +1000\r\n" +
+	"From: from@example.com\r\n" +
+	"To: body@example.com\r\n" +
+	"Subject: password reset\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=\"inner\"\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/plain; charset=iso-8859-1\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Your reset token is zxq7token. Merci, Ren=E9e\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"PGh0bWw+PGhlYWQ+PHN0eWxlPnAge2NvbG9yOiByZWR9PC9zdHlsZT48L2hlYWQ+PGJvZHk+PHA+\r\n" +
+	"T3JkZXIgJmFtcDsgbnVtYmVyIDxiPjQ0MTIzPC9iPjwvcD48L2JvZHk+PC9odG1sPg==\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"Content-Disposition: attachment; filename=\"secret.txt\"\r\n" +
+	"\r\n" +
+	"attachedonly\r\n" +
+	"--outer--\r\n"
+
+func TestMessageText(t *testing.T) {
+	msg, err := mail.ReadMessage(strings.NewReader(multipartStr))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	content := parseContent(msg)
+	text := content.Text
+	for _, s := range []string{"zxq7token", "Renée", "Order & number", "44123"} {
+		if !strings.Contains(text, s) {
+			t.Errorf("expected text to contain '%s', got '%s'", s, text)
+		}
+	}
+	for _, s := range []string{"attachedonly", "color", "<p>"} {
+		if strings.Contains(text, s) {
+			t.Errorf("expected text not to contain '%s', got '%s'", s, text)
+		}
+	}
+
+	if len(content.Attachments) != 1 {
+		t.Fatalf("expected 1 attachment, got %+v", content.Attachments)
+	}
+	if a := content.Attachments[0]; a.Filename != "secret.txt" || a.ContentType != "text/plain" || a.Size != 12 || a.Disposition != "attachment" {
+		t.Errorf("unexpected attachment %+v", a)
+	}
+
+	if s := decodeCharset([]byte{0x93, 'h', 'i', 0x94, 0x80}, "windows-1252"); s != "“hi”€" {
+		t.Errorf("unexpected windows-1252 decoding '%s'", s)
+	}
+	for charset, tc := range map[string]struct {
+		in   []byte
+		want string
+	}{
+		"ISO-8859-2": {[]byte{0xa3, 0xf3, 'd', 0xbc}, "Łódź"},
+		"koi8-r":     {[]byte{0xf0, 0xd2, 0xc9, 0xd7, 0xc5, 0xd4}, "Привет"},
+		"Shift_JIS":  {[]byte{0x82, 0xb1, 0x82, 0xf1, 0x82, 0xc9, 0x82, 0xbf, 0x82, 0xcd}, "こんにちは"},
+		"gb2312":     {[]byte{0xc4, 0xe3, 0xba, 0xc3}, "你好"},
+		"x-unknown":  {[]byte("as is"), "as is"},
+	} {
+		if s := decodeCharset(tc.in, charset); s != tc.want {
+			t.Errorf("unexpected %s decoding '%s', expected '%s'", charset, s, tc.want)
+		}
+	}
+}
+
+func TestSearchBody(t *testing.T) {
+	if err := handleMessage(nil, "from@example.com", []string{"body@example.com"}, []byte(multipartStr)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for location, want := range map[string]int{bodyLocation: 1, "Subject": 0} {
+		bQuery, err := buildQuery(SearchRequest{Query: "zxq7token", Locations: []string{location}})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		docs, err := matchingDocs(bQuery)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(docs) != want {
+			t.Errorf("expected %d matches in %s, got %d", want, location, len(docs))
+		}
+	}
+
+	// body text survives updates
+	bQuery, _ := buildQuery(SearchRequest{Query: "zxq7token", Locations: []string{bodyLocation}})
+	docs, _ := matchingDocs(bQuery)
+	if len(docs) == 1 {
+		if _, err := tagDoc(docs[0].ID, "body-test"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if docs, _ = matchingDocs(bQuery); len(docs) != 1 {
+			t.Errorf("expected body to remain searchable after tagging")
+		}
+	}
+}
+
+func TestSearchAttachments(t *testing.T) {
+	if err := handleMessage(nil, "from@example.com", []string{"attach@example.com"}, []byte(multipartStr)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	yes, no := true, false
+	tests := []struct {
+		request SearchRequest
+		match   bool
+	}{
+		{SearchRequest{HasAttachment: &yes}, true},
+		{SearchRequest{HasAttachment: &no}, false},
+		{SearchRequest{Filename: "secret.txt"}, true},
+		{SearchRequest{Filename: "invoice.pdf"}, false},
+		{SearchRequest{ContentType: "text/*"}, true},
+		{SearchRequest{ContentType: "application/pdf"}, false},
+	}
+	for _, test := range tests {
+		test.request.Query = "zxq7token"
+		test.request.Locations = []string{bodyLocation}
+		bQuery, err := buildQuery(test.request)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		docs, err := matchingDocs(bQuery)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if (len(docs) > 0) != test.match {
+			t.Errorf("expected match %v for %+v, got %d results", test.match, test.request, len(docs))
+		}
+	}
+}
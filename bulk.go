@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search/query"
+	"github.com/gorilla/mux"
+)
+
+// number of hits fetched per search when collecting every match of a query
+const bulkPageSize = 1000
+
+type BulkHandler struct{}
+
+// BulkRequest selects messages with the same fields as SearchRequest. Limit
+// and Offset are ignored: the action applies to every match.
+type BulkRequest struct {
+	SearchRequest
+	// tag added by the 'tag' action
+	Tag string
+	// change made by the 'state' action
+	State StateRequest
+	// only report which messages would be affected
+	DryRun bool
+
+	actor releaseActor
+}
+
+type BulkResult struct {
+	Action  string
+	DryRun  bool
+	Total   int
+	Failed  int
+	Results []BulkItemResult
+}
+
+type BulkItemResult struct {
+	ID      string
+	Subject string
+	Success bool
+	Error   string `json:",omitempty"`
+}
+
+// matchedDoc is a message matched by a query
+type matchedDoc struct {
+	ID      string
+	Subject string
+}
+
+var bulkActions = map[string]func(docID string, bulkRequest BulkRequest) (int, error){
+	"release": func(docID string, bulkRequest BulkRequest) (int, error) {
+		return sendMailDoc(docID, bulkRequest.actor)
+	},
+	"delete": func(docID string, _ BulkRequest) (int, error) {
+		return deleteDoc(docID)
+	},
+	"tag": func(docID string, bulkRequest BulkRequest) (int, error) {
+		return tagDoc(docID, bulkRequest.Tag)
+	},
+	"state": func(docID string, bulkRequest BulkRequest) (int, error) {
+		return setState(docID, bulkRequest.State)
+	},
+}
+
+func (h *BulkHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	actionName := mux.Vars(req)["action"]
+	action, ok := bulkActions[actionName]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown bulk action '%s'", actionName), 404)
+		return
+	}
+
+	// read the request body
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error reading request body: %v", err), 400)
+		return
+	}
+
+	// parse the request
+	var bulkRequest BulkRequest
+	err = json.Unmarshal(requestBody, &bulkRequest)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error parsing request: %v", err), 400)
+		return
+	}
+	bulkRequest.actor = requestActor(req)
+	if actionName == "tag" && bulkRequest.Tag == "" {
+		http.Error(w, "tag action requires a Tag", 400)
+		return
+	}
+
+	bQuery, err := buildQuery(bulkRequest.SearchRequest)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), 400)
+		return
+	}
+	// as for DeleteQueryHandler, an empty request would match everything
+	if _, ok := bQuery.(*query.MatchAllQuery); ok && !bulkRequest.DryRun && (actionName == "delete" || actionName == "release") {
+		http.Error(w, fmt.Sprintf("%s action requires a query or filter", actionName), 400)
+		return
+	}
+
+	docs, err := matchingDocs(bQuery)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), 500)
+		return
+	}
+
+	result := BulkResult{Action: actionName, DryRun: bulkRequest.DryRun, Total: len(docs)}
+	result.Results = make([]BulkItemResult, 0, len(docs))
+	for _, doc := range docs {
+		item := BulkItemResult{ID: doc.ID, Subject: doc.Subject, Success: true}
+		if !bulkRequest.DryRun {
+			if _, err := action(doc.ID, bulkRequest); err != nil {
+				item.Success = false
+				item.Error = err.Error()
+				result.Failed++
+			}
+		}
+		result.Results = append(result.Results, item)
+	}
+
+	mustEncode(w, result)
+}
+
+// matchingDocs returns every message matched by the query, newest first
+func matchingDocs(bQuery query.Query) ([]matchedDoc, error) {
+	docs := make([]matchedDoc, 0)
+	for {
+		bRequest := bleve.NewSearchRequestOptions(bQuery, bulkPageSize, len(docs), false)
+		bRequest.SortBy([]string{"-Header.Date", "_id"})
+		bRequest.Fields = []string{"Header.Subject"}
+
+		searchResult, err := index.Search(bRequest)
+		if err != nil {
+			return nil, fmt.Errorf("error executing query: %v", err)
+		}
+		for _, hit := range searchResult.Hits {
+			docs = append(docs, matchedDoc{ID: hit.ID, Subject: fieldString(hit.Fields["Header.Subject"])})
+		}
+		if len(searchResult.Hits) < bulkPageSize {
+			break
+		}
+	}
+	return docs, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestBulkTag(t *testing.T) {
+	if err := handleMessage(nil, "from@example.com", []string{"to@example.com"}, []byte(emailStr)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	router := mux.NewRouter()
+	router.Handle("/api/bulk/{action}", &BulkHandler{}).Methods("POST")
+
+	bulk := func(body string) BulkResult {
+		req := httptest.NewRequest("POST", "/api/bulk/tag", bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+		}
+		var result BulkResult
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return result
+	}
+
+	result := bulk(`{"Query": "test subject", "Locations": ["Subject"], "Tag": "reviewed", "DryRun": true}`)
+	if result.Total == 0 {
+		t.Fatalf("expected dry run to match messages")
+	}
+	if n := countTagged("reviewed"); n != 0 {
+		t.Errorf("dry run tagged %d messages", n)
+	}
+
+	result = bulk(`{"Query": "test subject", "Locations": ["Subject"], "Tag": "reviewed"}`)
+	if result.Failed != 0 {
+		t.Errorf("unexpected failures: %+v", result.Results)
+	}
+	if n := countTagged("reviewed"); n != result.Total {
+		t.Errorf("expected %d tagged messages, got %d", result.Total, n)
+	}
+}
+
+func countTagged(tag string) int {
+	bQuery, err := buildQuery(SearchRequest{Tags: []string{tag}})
+	if err != nil {
+		return -1
+	}
+	docs, err := matchingDocs(bQuery)
+	if err != nil {
+		return -1
+	}
+	return len(docs)
+}
+
+func TestBulkRequiresQuery(t *testing.T) {
+	router := mux.NewRouter()
+	router.Handle("/api/bulk/{action}", &BulkHandler{}).Methods("POST")
+
+	tests := []struct {
+		action string
+		body   string
+		status int
+	}{
+		{"delete", `{}`, http.StatusBadRequest},
+		{"release", `{"Tags": []}`, http.StatusBadRequest},
+		{"delete", `{"DryRun": true}`, http.StatusOK},
+		{"delete", `{"Tags": ["no-such-tag"]}`, http.StatusOK},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("POST", "/api/bulk/"+test.action, bytes.NewBufferString(test.body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != test.status {
+			t.Errorf("expected %s of %s to return %d, got %d", test.action, test.body, test.status, w.Code)
+		}
+	}
+}
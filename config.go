@@ -3,6 +3,8 @@ package main
 import (
 	"flag"
 	"fmt"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 )
@@ -32,8 +34,127 @@ type tomlConfig struct {
 	SMTPServerPassword string `toml:"smtp_server_password"`
 
 	StorageDir string `toml:"storage_dir"`
+	Storage    string `toml:"storage"`
+	// cap in bytes on the messages kept with memory storage
+	MemoryMaxSize int `toml:"memory_max_size"`
 
 	Whitelist []string `toml:"whitelist"`
+
+	DKIM []dkimConfig `toml:"dkim"`
+
+	VerifyAuth  bool   `toml:"verify_auth"`
+	DNSServer   string `toml:"dns_server"`
+	DNSZoneFile string `toml:"dns_zone_file"`
+
+	RateLimit rateLimitConfig `toml:"rate_limit"`
+
+	ReturnPath     string `toml:"return_path"`
+	ReturnPathVERP bool   `toml:"return_path_verp"`
+
+	DSN        bool `toml:"dsn"`
+	DSNDeliver bool `toml:"dsn_deliver"`
+
+	Retention retentionConfig `toml:"retention"`
+	// messages with the same content as one received within this long
+	// before are flagged as duplicates
+	DuplicateWindow duration `toml:"duplicate_window"`
+
+	Transport      string                `toml:"transport"`
+	Transports     []transportConfig     `toml:"transports"`
+	TransportRules []transportRuleConfig `toml:"transport_rules"`
+}
+
+type rateLimitConfig struct {
+	Global    rateConfig `toml:"global"`
+	PerDomain rateConfig `toml:"per_domain"`
+	PerRelay  rateConfig `toml:"per_relay"`
+
+	// overrides for specific recipient domains and relays
+	Domains map[string]rateConfig `toml:"domains"`
+	Relays  map[string]rateConfig `toml:"relays"`
+}
+
+// rateConfig is a token bucket limit. A rate of zero means unlimited.
+type rateConfig struct {
+	// messages per second
+	Rate  float64 `toml:"rate"`
+	Burst int     `toml:"burst"`
+}
+
+// retentionConfig holds the global retention policy, which applies to all
+// messages, and further policies for particular mailboxes or states
+type retentionConfig struct {
+	retentionPolicy
+	Interval duration          `toml:"interval"`
+	Rules    []retentionPolicy `toml:"rules"`
+}
+
+// retentionPolicy limits the messages matching Mailbox and State. Zero limits
+// are unlimited.
+type retentionPolicy struct {
+	// recipient address or domain, in the same form as the whitelist
+	Mailbox string `toml:"mailbox"`
+	// "delivered", "held" or empty for both
+	State string `toml:"state"`
+
+	MaxAge   duration `toml:"max_age"`
+	MaxCount int      `toml:"max_count"`
+	// total bytes of raw message data
+	MaxSize int `toml:"max_size"`
+}
+
+// duration is a time.Duration read from a string such as "72h"
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// enabled reports whether any retention limit is configured
+func (c retentionConfig) enabled() bool {
+	for _, p := range append([]retentionPolicy{c.retentionPolicy}, c.Rules...) {
+		if p.MaxAge.Duration > 0 || p.MaxCount > 0 || p.MaxSize > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+type transportConfig struct {
+	Name string `toml:"name"`
+	// one of "http", "file" or "command"
+	Type string `toml:"type"`
+
+	// http
+	URL     string            `toml:"url"`
+	Format  string            `toml:"format"`
+	Headers map[string]string `toml:"headers"`
+
+	// file
+	Dir string `toml:"dir"`
+
+	// command, and how long it may run. Defaults to a minute.
+	Command []string `toml:"command"`
+	Timeout duration `toml:"timeout"`
+}
+
+// transportRuleConfig selects a transport for messages from any of the From
+// addresses/domains and to any of the Recipients addresses/domains. An empty
+// list matches anything.
+type transportRuleConfig struct {
+	From       []string `toml:"from"`
+	Recipients []string `toml:"recipients"`
+	Transport  string   `toml:"transport"`
+}
+
+type dkimConfig struct {
+	Domain         string `toml:"domain"`
+	Selector       string `toml:"selector"`
+	PrivateKeyFile string `toml:"private_key_file"`
 }
 
 func loadConfig() error {
@@ -64,6 +185,24 @@ func loadConfig() error {
 	if config.SMTPServerAddr == "" {
 		config.SMTPServerAddr = smtpServerAddr
 	}
+	if config.ReturnPathVERP && !strings.Contains(config.ReturnPath, "@") {
+		return fmt.Errorf("return_path_verp requires return_path to be an address")
+	}
+	for _, p := range config.Retention.Rules {
+		if p.State != "" && p.State != "delivered" && p.State != "held" {
+			return fmt.Errorf("invalid retention state '%s'", p.State)
+		}
+	}
+	switch config.Storage {
+	case "":
+		config.Storage = boltStorage
+	case boltStorage, fileStorage, memoryStorage:
+	default:
+		return fmt.Errorf("invalid storage '%s'", config.Storage)
+	}
+	if config.Transport == "" {
+		config.Transport = smtpTransportName
+	}
 
 	return nil
 }
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/blevesearch/bleve/search/query"
+	"github.com/gorilla/mux"
+)
+
+type DeleteHandler struct{}
+type DeleteQueryHandler struct{}
+type PurgeHandler struct{}
+
+type DeleteResult struct {
+	Deleted int
+}
+
+// DeleteHandler removes a single message
+func (h *DeleteHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	docID := mux.Vars(req)["docID"]
+
+	httpStatus, err := deleteDoc(docID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), httpStatus)
+		return
+	}
+
+	mustEncode(w, MailResult{Success: true})
+}
+
+// DeleteQueryHandler removes every message matching a SearchRequest, which
+// must have a query or at least one filter
+func (h *DeleteQueryHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// read the request body
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error reading request body: %v", err), 400)
+		return
+	}
+
+	// parse the request
+	var searchRequest SearchRequest
+	err = json.Unmarshal(requestBody, &searchRequest)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error parsing request: %v", err), 400)
+		return
+	}
+
+	bQuery, err := buildQuery(searchRequest)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), 400)
+		return
+	}
+	// an empty request matches everything, which is what purge is for
+	if _, ok := bQuery.(*query.MatchAllQuery); ok {
+		http.Error(w, "a query or filter is required", 400)
+		return
+	}
+
+	docs, err := matchingDocs(bQuery)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), 500)
+		return
+	}
+	ids := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		ids = append(ids, doc.ID)
+	}
+
+	if err = deleteDocs(ids); err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), 500)
+		return
+	}
+
+	mustEncode(w, DeleteResult{Deleted: len(ids)})
+}
+
+// PurgeHandler removes all messages, or only those to the recipient address
+// or domain given by the 'mailbox' parameter
+func (h *PurgeHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	mailbox := req.URL.Query().Get("mailbox")
+
+	deleted, err := purge(mailbox)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), 500)
+		return
+	}
+
+	mustEncode(w, DeleteResult{Deleted: deleted})
+}
+
+// purge deletes every message, or every message with a recipient matching
+// mailbox, returning the number deleted
+func purge(mailbox string) (int, error) {
+	docs, err := retainedDocs()
+	if err != nil {
+		return 0, err
+	}
+
+	ids := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		if (retentionPolicy{Mailbox: mailbox}).applies(doc) {
+			ids = append(ids, doc.ID)
+		}
+	}
+
+	if err = deleteDocs(ids); err != nil {
+		return 0, err
+	}
+	if mailbox == "" {
+		log.Printf("Purged all %d messages\n", len(ids))
+	} else {
+		log.Printf("Purged %d messages for mailbox '%s'\n", len(ids), mailbox)
+	}
+	return len(ids), nil
+}
+
+// deleteDocs removes messages, their history, notes and state in batches
+func deleteDocs(ids []string) error {
+	for start := 0; start < len(ids); start += bulkPageSize {
+		end := start + bulkPageSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+		if err := deleteBatch(ids[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteBatch removes one batch of messages, with each of them locked
+// against updates and releases
+func deleteBatch(ids []string) error {
+	// locked in order, so concurrent deletes can't deadlock
+	sorted := append([]string(nil), ids...)
+	sort.Strings(sorted)
+	for _, id := range sorted {
+		unlock := lockDoc(id)
+		defer unlock()
+	}
+
+	batch := index.NewBatch()
+	for _, id := range ids {
+		batch.Delete(id)
+		batch.DeleteInternal(historyKey(id))
+		batch.DeleteInternal(notesKey(id))
+		batch.DeleteInternal(stateKey(id))
+	}
+	if err := index.Batch(batch); err != nil {
+		return fmt.Errorf("error deleting messages: %s", err)
+	}
+	for _, id := range ids {
+		if err := msgStore.Delete(id); err != nil {
+			return fmt.Errorf("error deleting message %s: %s", id, err)
+		}
+	}
+	return nil
+}
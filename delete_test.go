@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestDelete(t *testing.T) {
+	router := mux.NewRouter()
+	router.Handle("/api/messages/{docID}", &DeleteHandler{}).Methods("DELETE")
+	router.Handle("/api/messages", &PurgeHandler{}).Methods("DELETE")
+	router.Handle("/api/delete", &DeleteQueryHandler{}).Methods("POST")
+
+	do := func(method, url, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	deleted := func(w *httptest.ResponseRecorder) int {
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+		}
+		var result DeleteResult
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return result.Deleted
+	}
+
+	for _, to := range []string{"a@delete.example.com", "b@delete.example.com", "c@purge.example.com", "d@purge.example.org"} {
+		if err := handleMessage(nil, "from@example.com", []string{to}, []byte(emailStr)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	docs, err := retainedDocs()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var single string
+	for _, doc := range docs {
+		if len(doc.Recipients) == 1 && doc.Recipients[0] == "a@delete.example.com" {
+			single = doc.ID
+		}
+	}
+
+	if w := do("DELETE", "/api/messages/"+single, ""); w.Code != http.StatusOK {
+		t.Errorf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	if w := do("DELETE", "/api/messages/"+single, ""); w.Code != http.StatusNotFound {
+		t.Errorf("expected deleting twice to return 404, got %d", w.Code)
+	}
+
+	if n := deleted(do("DELETE", "/api/messages?mailbox=purge.example.com", "")); n != 1 {
+		t.Errorf("expected 1 message purged from mailbox, got %d", n)
+	}
+
+	if n := deleted(do("POST", "/api/delete", `{"Tags": ["no-such-tag"]}`)); n != 0 {
+		t.Errorf("expected no messages deleted, got %d", n)
+	}
+
+	for _, body := range []string{`{}`, `{"Limit": 10, "Tags": []}`} {
+		if w := do("POST", "/api/delete", body); w.Code != http.StatusBadRequest {
+			t.Errorf("expected an empty delete query to return 400, got %d", w.Code)
+		}
+	}
+
+	if n := deleted(do("DELETE", "/api/messages", "")); n == 0 {
+		t.Errorf("expected purge to delete messages")
+	}
+	if count, err := index.DocCount(); err != nil || count != 0 {
+		t.Errorf("expected empty index after purge, got %d (%v)", count, err)
+	}
+}
+
+func TestDeleteLocked(t *testing.T) {
+	if err := handleMessage(nil, "from@example.com", []string{"locked@delete.example.com"}, []byte(emailStr)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	docs, err := retainedDocs()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var id string
+	for _, doc := range docs {
+		if len(doc.Recipients) == 1 && doc.Recipients[0] == "locked@delete.example.com" {
+			id = doc.ID
+		}
+	}
+
+	// a delete waits for an update in progress, which can't bring the
+	// message back
+	unlock := lockDoc(id)
+	done := make(chan struct{})
+	go func() {
+		if _, err := deleteDoc(id); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatalf("expected delete to wait for the lock")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	<-done
+
+	if httpStatus, err := setState(id, StateRequest{AddLabels: []string{"late"}}); httpStatus != 404 {
+		t.Errorf("expected an update after the delete to return 404, got %d (%v)", httpStatus, err)
+	}
+	if doc, err := index.Document(id); err != nil || doc != nil {
+		t.Errorf("expected the message to stay deleted (%v)", err)
+	}
+}
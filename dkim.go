@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// dkimSignedHeaders is the list of header fields included in DKIM signatures.
+// Fields not present in the message are skipped at signing time.
+var dkimSignedHeaders = []string{
+	"From",
+	"Sender",
+	"Reply-To",
+	"To",
+	"Cc",
+	"Subject",
+	"Date",
+	"Message-ID",
+	"In-Reply-To",
+	"References",
+	"MIME-Version",
+	"Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+var dkimSigners map[string]*dkimSigner
+
+type dkimSigner struct {
+	Domain   string
+	Selector string
+	key      *rsa.PrivateKey
+}
+
+// headerField is a single raw header field as it appears in the message,
+// including any folding whitespace
+type headerField struct {
+	Name  string
+	Value string
+}
+
+func loadDKIMSigners(confs []dkimConfig) (map[string]*dkimSigner, error) {
+	signers := make(map[string]*dkimSigner)
+	for _, c := range confs {
+		if c.Domain == "" || c.Selector == "" || c.PrivateKeyFile == "" {
+			return nil, fmt.Errorf("dkim entry requires domain, selector and private_key_file")
+		}
+		key, err := loadRSAPrivateKey(c.PrivateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading DKIM key for domain '%s': %s", c.Domain, err)
+		}
+		signers[strings.ToLower(c.Domain)] = &dkimSigner{Domain: c.Domain, Selector: c.Selector, key: key}
+	}
+	return signers, nil
+}
+
+func loadRSAPrivateKey(filename string) (*rsa.PrivateKey, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in '%s'", filename)
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := k.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("key in '%s' is not an RSA key", filename)
+	}
+	return key, nil
+}
+
+// dkimSignerFor returns the signer configured for the domain of the message's
+// From address, or nil if there isn't one
+func dkimSignerFor(msg mail.Message) *dkimSigner {
+	if len(dkimSigners) == 0 {
+		return nil
+	}
+	addresses, err := msg.Header.AddressList("From")
+	if err != nil || len(addresses) == 0 {
+		return nil
+	}
+	return dkimSigners[strings.ToLower(addressDomain(addresses[0].Address))]
+}
+
+// addressDomain returns the part of an email address after the '@'
+func addressDomain(address string) string {
+	if i := strings.LastIndex(address, "@"); i >= 0 {
+		return address[i+1:]
+	}
+	return ""
+}
+
+// Sign returns a DKIM-Signature header field (including trailing CRLF) for
+// the message data. Relaxed canonicalization is used for header and body.
+func (s *dkimSigner) Sign(data []byte) (string, error) {
+	fields, body := splitMessage(data)
+
+	bodyHash := sha256.Sum256(dkimCanonicalBodyRelaxed(body))
+
+	present := make(map[string]int)
+	for _, f := range fields {
+		present[strings.ToLower(f.Name)]++
+	}
+	signed := make([]string, 0)
+	for _, h := range dkimSignedHeaders {
+		for i := 0; i < present[strings.ToLower(h)]; i++ {
+			signed = append(signed, strings.ToLower(h))
+		}
+	}
+	if present["from"] == 0 {
+		return "", fmt.Errorf("message has no From header")
+	}
+
+	sigValue := fmt.Sprintf(" v=1; a=rsa-sha256; c=relaxed/relaxed; d=%s; s=%s;\r\n\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		s.Domain, s.Selector, time.Now().Unix(), strings.Join(signed, ":"),
+		base64.StdEncoding.EncodeToString(bodyHash[:]))
+
+	h := sha256.New()
+	h.Write(dkimCanonicalHeaders(fields, signed))
+	h.Write([]byte(strings.TrimSuffix(dkimCanonicalHeaderRelaxed(headerField{"DKIM-Signature", sigValue}), "\r\n")))
+
+	sig, err := rsa.SignPKCS1v15(nil, s.key, crypto.SHA256, h.Sum(nil))
+	if err != nil {
+		return "", err
+	}
+
+	return "DKIM-Signature:" + sigValue + base64.StdEncoding.EncodeToString(sig) + "\r\n", nil
+}
+
+// splitMessage separates raw message data into header fields and body.
+// Line endings are normalised to CRLF, matching what goes out over SMTP.
+func splitMessage(data []byte) ([]headerField, []byte) {
+	data = bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+	data = bytes.Replace(data, []byte("\n"), []byte("\r\n"), -1)
+
+	var head, body []byte
+	if i := bytes.Index(data, []byte("\r\n\r\n")); i >= 0 {
+		head = data[:i+2]
+		body = data[i+4:]
+	} else {
+		head = data
+	}
+
+	fields := make([]headerField, 0)
+	for _, line := range strings.SplitAfter(string(head), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].Value += line
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		fields = append(fields, headerField{Name: line[:i], Value: line[i+1:]})
+	}
+
+	return fields, body
+}
+
+// dkimCanonicalHeaders returns the relaxed canonical form of the named header
+// fields. Where a name appears more than once, instances are consumed from
+// the bottom of the header up, per RFC 6376 section 5.4.2.
+func dkimCanonicalHeaders(fields []headerField, names []string) []byte {
+	used := make(map[int]bool)
+	var buf bytes.Buffer
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(strings.TrimSpace(fields[i].Name), name) {
+				continue
+			}
+			used[i] = true
+			buf.WriteString(dkimCanonicalHeaderRelaxed(fields[i]))
+			break
+		}
+	}
+	return buf.Bytes()
+}
+
+func dkimCanonicalHeaderRelaxed(f headerField) string {
+	name := strings.ToLower(strings.TrimSpace(f.Name))
+	value := strings.Replace(f.Value, "\r\n", "", -1)
+	value = strings.TrimSpace(collapseWSP(value))
+	return name + ":" + value + "\r\n"
+}
+
+func dkimCanonicalBodyRelaxed(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(collapseWSP(l), " ")
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return []byte{}
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// collapseWSP reduces each run of spaces and tabs to a single space
+func collapseWSP(s string) string {
+	var b strings.Builder
+	inWSP := false
+	for _, r := range s {
+		if r == ' ' || r == '\t' {
+			if !inWSP {
+				b.WriteByte(' ')
+			}
+			inWSP = true
+			continue
+		}
+		inWSP = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
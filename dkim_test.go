@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// example from RFC 6376 section 3.4.6
+const dkimCanonStr = "A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n"
+
+func TestDKIMCanonicalization(t *testing.T) {
+	fields, body := splitMessage([]byte(dkimCanonStr))
+
+	h := string(dkimCanonicalHeaders(fields, []string{"a", "b"}))
+	if h != "a:X\r\nb:Y Z\r\n" {
+		t.Errorf("unexpected canonical header %q", h)
+	}
+
+	b := string(dkimCanonicalBodyRelaxed(body))
+	if b != " C\r\nD E\r\n" {
+		t.Errorf("unexpected canonical body %q", b)
+	}
+}
+
+func TestDKIMSign(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	signer := &dkimSigner{Domain: "example.com", Selector: "test", key: key}
+
+	header, err := signer.Sign([]byte(emailStr))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	fields, _ := splitMessage([]byte(header))
+	if len(fields) != 1 || fields[0].Name != "DKIM-Signature" {
+		t.Fatalf("unexpected signature header %q", header)
+	}
+	for _, tag := range []string{"d=example.com", "s=test", "h=from:to:cc:subject:date", "bh="} {
+		if !strings.Contains(fields[0].Value, tag) {
+			t.Errorf("expected tag '%s' in signature %q", tag, fields[0].Value)
+		}
+	}
+
+	// verify the signature against the message with b= emptied
+	bRe := regexp.MustCompile(`b=([^;]*)$`)
+	m := bRe.FindStringSubmatch(strings.TrimRight(fields[0].Value, "\r\n"))
+	if m == nil {
+		t.Fatalf("no b= tag in signature %q", fields[0].Value)
+	}
+	sig, err := base64.StdEncoding.DecodeString(m[1])
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	unsigned := fields[0]
+	unsigned.Value = strings.TrimSuffix(strings.TrimRight(unsigned.Value, "\r\n"), m[1])
+
+	msgFields, _ := splitMessage([]byte(emailStr))
+	h := sha256.New()
+	h.Write(dkimCanonicalHeaders(msgFields, []string{"from", "to", "cc", "subject", "date"}))
+	h.Write([]byte(strings.TrimSuffix(dkimCanonicalHeaderRelaxed(unsigned), "\r\n")))
+	if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, h.Sum(nil), sig); err != nil {
+		t.Errorf("signature did not verify: %s", err)
+	}
+}
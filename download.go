@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Content-Type of entities without one, per RFC 2045
+const defaultContentType = "text/plain; charset=us-ascii"
+
+type RawHandler struct{}
+type PartHandler struct{}
+type AttachmentHandler struct{}
+
+// entityData is the decoded content of a MIME entity
+type entityData struct {
+	ContentType string
+	Data        []byte
+}
+
+// RawHandler downloads the message as received
+func (h *RawHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	docID := mux.Vars(req)["docID"]
+
+	raw, _, httpStatus, err := getMessage(docID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), httpStatus)
+		return
+	}
+
+	w.Header().Set("Content-Type", "message/rfc822")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": docID + ".eml"}))
+	io.WriteString(w, raw)
+}
+
+// PartHandler downloads the MIME part at a path such as "2.1", numbered as
+// in IMAP: the parts of a multipart are numbered from 1, and part 1 of a
+// message which isn't multipart is its body
+func (h *PartHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	docID := mux.Vars(req)["docID"]
+
+	path, err := parsePartPath(mux.Vars(req)["path"])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), 400)
+		return
+	}
+
+	_, msg, httpStatus, err := getMessage(docID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), httpStatus)
+		return
+	}
+
+	header, part, err := findPart(textproto.MIMEHeader(msg.Header), msg.Body, path, true, 0)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("part %s of mail with ID %s %s", mux.Vars(req)["path"], docID, err), 404)
+		return
+	}
+
+	disposition, params, _ := mime.ParseMediaType(header.Get("Content-Disposition"))
+	if disposition == "" {
+		disposition = "inline"
+	}
+	filename := params["filename"]
+	if filename == "" {
+		_, typeParams, _ := mime.ParseMediaType(header.Get("Content-Type"))
+		filename = typeParams["name"]
+	}
+	if dec, err := new(mime.WordDecoder).DecodeHeader(filename); err == nil {
+		filename = dec
+	}
+	writeEntity(w, entityData{ContentType: header.Get("Content-Type"), Data: part}, disposition, filename)
+}
+
+// AttachmentHandler downloads an attachment, by its index in the message's
+// Attachments or by filename
+func (h *AttachmentHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	docID := mux.Vars(req)["docID"]
+	ref := mux.Vars(req)["attachment"]
+
+	_, msg, httpStatus, err := getMessage(docID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), httpStatus)
+		return
+	}
+
+	var text []string
+	var attachments []attachment
+	var data []entityData
+	walkContent(textproto.MIMEHeader(msg.Header), msg.Body, &text, &attachments, &data, 0)
+
+	i, err := strconv.Atoi(ref)
+	if err != nil {
+		i = -1
+		for j, a := range attachments {
+			if a.Filename == ref {
+				i = j
+				break
+			}
+		}
+	}
+	if i < 0 || i >= len(attachments) {
+		http.Error(w, fmt.Sprintf("mail with ID %s has no attachment '%s'", docID, ref), 404)
+		return
+	}
+
+	writeEntity(w, data[i], "attachment", attachments[i].Filename)
+}
+
+// writeEntity sends decoded content with its own content type. Content is
+// sandboxed as it may be HTML from an untrusted sender.
+func writeEntity(w http.ResponseWriter, entity entityData, disposition, filename string) {
+	contentType := entity.ContentType
+	if _, _, err := mime.ParseMediaType(contentType); err != nil {
+		contentType = defaultContentType
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	contentDisposition := disposition
+	if filename != "" {
+		if d := mime.FormatMediaType(disposition, map[string]string{"filename": filename}); d != "" {
+			contentDisposition = d
+		}
+	}
+	w.Header().Set("Content-Disposition", contentDisposition)
+	w.Write(entity.Data)
+}
+
+func parsePartPath(s string) ([]int, error) {
+	fields := strings.Split(s, ".")
+	path := make([]int, 0, len(fields))
+	for _, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid part path '%s'", s)
+		}
+		path = append(path, n)
+	}
+	return path, nil
+}
+
+// findPart returns the header and decoded content of the entity at a part
+// path below the given one, which is a message or a MIME part. The parts of
+// a message/rfc822 part are numbered as those of the message it holds.
+func findPart(header textproto.MIMEHeader, body io.Reader, path []int, isMessage bool, depth int) (textproto.MIMEHeader, []byte, error) {
+	// guard against pathologically nested messages
+	if depth > 10 {
+		return nil, nil, fmt.Errorf("is nested too deeply")
+	}
+	if len(path) == 0 {
+		b, err := ioutil.ReadAll(transferDecoder(header, body))
+		if err != nil {
+			return nil, nil, fmt.Errorf("can't be decoded: %s", err)
+		}
+		return header, b, nil
+	}
+
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		mr := multipart.NewReader(body, params["boundary"])
+		for i := 1; ; i++ {
+			p, err := mr.NextPart()
+			if err != nil {
+				return nil, nil, fmt.Errorf("not found")
+			}
+			if i == path[0] {
+				// quoted-printable parts are already decoded by NextPart
+				return findPart(p.Header, p, path[1:], false, depth+1)
+			}
+		}
+	case mediaType == "message/rfc822" && !isMessage:
+		msg, err := mail.ReadMessage(transferDecoder(header, body))
+		if err != nil {
+			return nil, nil, fmt.Errorf("can't be parsed: %s", err)
+		}
+		return findPart(textproto.MIMEHeader(msg.Header), msg.Body, path, true, depth+1)
+	case isMessage && len(path) == 1 && path[0] == 1:
+		return findPart(header, body, nil, false, depth)
+	}
+	return nil, nil, fmt.Errorf("not found")
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+const downloadStr = "Date: Tue, 04 Apr 2017 19:02:05 +1000\r\n" +
+	"From: from@example.com\r\n" +
+	"To: to@example.com\r\n" +
+	"Subject: report attached\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+	"\r\n" +
+	"--outer\r\n" +
+	"Content-Type: text/html; charset=iso-8859-1\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"<p>Ren=E9e</p>\r\n" +
+	"--outer\r\n" +
+	"Content-Type: text/csv; name=\"report.csv\"\r\n" +
+	"Content-Disposition: attachment; filename=\"report.csv\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"YSxiCjEsMgo=\r\n" +
+	"--outer\r\n" +
+	"Content-Type: message/rfc822\r\n" +
+	"\r\n" +
+	"Subject: forwarded\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"\r\n" +
+	"original text\r\n" +
+	"--outer--\r\n"
+
+func TestDownloads(t *testing.T) {
+	defer purge("download@example.com")
+	router := mux.NewRouter()
+	registerAPIv1(router)
+
+	if err := handleMessage(nil, "from@example.com", []string{"download@example.com"}, []byte(downloadStr)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	docs, err := retainedDocs()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var id string
+	for _, doc := range docs {
+		if len(doc.Recipients) == 1 && doc.Recipients[0] == "download@example.com" {
+			id = doc.ID
+		}
+	}
+
+	tests := []struct {
+		path        string
+		status      int
+		contentType string
+		disposition string
+		body        string
+	}{
+		{"raw", 200, "message/rfc822", "attachment; filename=" + id + ".eml", downloadStr},
+		{"parts/1", 200, "text/html; charset=iso-8859-1", "inline", "<p>Ren\xe9e</p>"},
+		{"parts/2", 200, "text/csv; name=\"report.csv\"", "attachment; filename=report.csv", "a,b\n1,2\n"},
+		{"parts/3", 200, "message/rfc822", "inline", "Subject: forwarded\r\nContent-Type: text/plain\r\n\r\noriginal text"},
+		{"parts/3.1", 200, "text/plain", "inline", "original text"},
+		{"parts/1.1", 404, "", "", ""},
+		{"parts/4", 404, "", "", ""},
+		{"parts/0", 400, "", "", ""},
+		{"attachments/0", 200, "text/csv; name=\"report.csv\"", "attachment; filename=report.csv", "a,b\n1,2\n"},
+		{"attachments/report.csv", 200, "text/csv; name=\"report.csv\"", "attachment; filename=report.csv", "a,b\n1,2\n"},
+		{"attachments/1", 404, "", "", ""},
+		{"attachments/other.csv", 404, "", "", ""},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/messages/"+id+"/"+test.path, nil))
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d: %s", test.path, test.status, w.Code, w.Body.String())
+			continue
+		}
+		if test.status != 200 {
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); ct != test.contentType {
+			t.Errorf("%s: expected Content-Type '%s', got '%s'", test.path, test.contentType, ct)
+		}
+		if cd := w.Header().Get("Content-Disposition"); cd != test.disposition {
+			t.Errorf("%s: expected Content-Disposition '%s', got '%s'", test.path, test.disposition, cd)
+		}
+		if w.Body.String() != test.body {
+			t.Errorf("%s: expected body %q, got %q", test.path, test.body, w.Body.String())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/v1/messages/missing/raw", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected a missing message to return 404, got %d", w.Code)
+	}
+}
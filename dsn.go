@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var enhancedStatusRe = regexp.MustCompile(`\b([245]\.\d{1,3}\.\d{1,3})\b`)
+
+// permanentError is implemented by transport errors which know whether
+// retrying could succeed
+type permanentError interface {
+	Permanent() bool
+}
+
+// isPermanentFailure reports whether a delivery error should generate a
+// bounce: a 5xx SMTP reply or a transport error marked permanent
+func isPermanentFailure(err error) bool {
+	switch e := err.(type) {
+	case *textproto.Error:
+		return e.Code >= 500 && e.Code <= 599
+	case permanentError:
+		return e.Permanent()
+	}
+	return false
+}
+
+// dsnStatus returns the enhanced status code of a failure, e.g. "5.1.1"
+func dsnStatus(err error) string {
+	if m := enhancedStatusRe.FindStringSubmatch(err.Error()); m != nil && m[1][0] == '5' {
+		return m[1]
+	}
+	return "5.0.0"
+}
+
+// reportingMTA is the name icemail uses for itself in DSNs
+func reportingMTA() string {
+	if host, err := os.Hostname(); err == nil && host != "" {
+		return host
+	}
+	return appName
+}
+
+// buildDSN returns an RFC 3464 delivery status notification, to be sent to
+// sender, reporting the failure to deliver the original message to each
+// failed recipient
+func buildDSN(original []byte, origMsg mail.Message, sender string, failures deliveryError, event releaseEvent) ([]byte, error) {
+	host := reportingMTA()
+	now := time.Now()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	// human readable explanation
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("Content-Description", "Notification")
+	pw, err := mw.CreatePart(h)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(pw, "This is the mail system at host %s.\r\n\r\n", host)
+	fmt.Fprintf(pw, "Your message could not be delivered to one or more recipients.\r\n\r\n")
+	for _, f := range failures {
+		fmt.Fprintf(pw, "<%s>: %s\r\n", f.Recipient, f.Err)
+	}
+
+	// machine readable status
+	h = make(textproto.MIMEHeader)
+	h.Set("Content-Type", "message/delivery-status")
+	h.Set("Content-Description", "Delivery report")
+	pw, err = mw.CreatePart(h)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(pw, "Reporting-MTA: dns; %s\r\n", host)
+	if date := origMsg.Header.Get("Date"); date != "" {
+		fmt.Fprintf(pw, "Arrival-Date: %s\r\n", date)
+	}
+	for _, f := range failures {
+		diagnostic := strings.Replace(f.Err.Error(), "\n", " ", -1)
+		fmt.Fprintf(pw, "\r\nFinal-Recipient: rfc822; %s\r\n", f.Recipient)
+		fmt.Fprintf(pw, "Action: failed\r\n")
+		fmt.Fprintf(pw, "Status: %s\r\n", dsnStatus(f.Err))
+		if event.Transport != "" {
+			fmt.Fprintf(pw, "Remote-MTA: x-icemail; %s\r\n", event.Transport)
+		}
+		fmt.Fprintf(pw, "Diagnostic-Code: smtp; %s\r\n", diagnostic)
+		fmt.Fprintf(pw, "Last-Attempt-Date: %s\r\n", event.Time.Format(time.RFC1123Z))
+	}
+
+	// headers of the original message
+	h = make(textproto.MIMEHeader)
+	h.Set("Content-Type", "text/rfc822-headers")
+	h.Set("Content-Description", "Undelivered message headers")
+	pw, err = mw.CreatePart(h)
+	if err != nil {
+		return nil, err
+	}
+	fields, _ := splitMessage(original)
+	for _, f := range fields {
+		pw.Write([]byte(f.Name + ":" + f.Value))
+	}
+
+	if err = mw.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", host)
+	fmt.Fprintf(&msg, "To: %s\r\n", sender)
+	fmt.Fprintf(&msg, "Subject: Undelivered Mail Returned to Sender\r\n")
+	fmt.Fprintf(&msg, "Date: %s\r\n", now.Format(RFC1123ZnoPadDay))
+	fmt.Fprintf(&msg, "Message-ID: <%d.dsn@%s>\r\n", now.UnixNano(), host)
+	if id := origMsg.Header.Get("Message-ID"); id != "" {
+		fmt.Fprintf(&msg, "In-Reply-To: %s\r\n", id)
+		fmt.Fprintf(&msg, "References: %s\r\n", id)
+	}
+	fmt.Fprintf(&msg, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/report; report-type=delivery-status; boundary=\"%s\"\r\n", mw.Boundary())
+	fmt.Fprintf(&msg, "\r\n")
+	msg.Write(body.Bytes())
+
+	return msg.Bytes(), nil
+}
+
+// bounceMessage stores a DSN for a permanently failed release as a new
+// message linked to the original, and optionally delivers it to the envelope
+// sender. The ID of the DSN is returned.
+func bounceMessage(docID string, original []byte, origMsg mail.Message, sender string, failures deliveryError, event releaseEvent) (string, error) {
+	if sender == "" {
+		return "", fmt.Errorf("mail with ID %s has a null sender", docID)
+	}
+
+	data, err := buildDSN(original, origMsg, sender, failures, event)
+	if err != nil {
+		return "", err
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+
+	id := fmt.Sprintf("%v", time.Now().UnixNano())
+	// DSNs are sent with the null sender so they can't themselves bounce
+	doc := bleveDoc{Type: "message", Header: msg.Header, Sender: nullSender, Recipients: []string{sender}, BounceOf: docID}
+	doc.setContent(msg)
+	doc.Received = time.Now()
+	doc.Size = len(data)
+
+	if config.DSNDeliver {
+		dsnEvent, dsnErr := sendMail(data, *msg, "", doc.Recipients)
+		dsnEvent.Actor = "dsn"
+		if doc.History, err = appendHistory(id, dsnEvent); err != nil {
+			return "", err
+		}
+		if dsnErr != nil {
+			log.Printf("Error delivering DSN for mail ID %s: %s\n", docID, dsnErr)
+		} else {
+			doc.Delivered = dsnEvent.Time
+		}
+	}
+
+	if err = storeDoc(id, data, doc); err != nil {
+		return "", err
+	}
+
+	log.Printf("Generated DSN ID %s for mail ID %s, To: '%s'\n", id, docID, sender)
+	return id, nil
+}
+
+// releaseFailed generates a DSN listing the recipients a release failed to
+// reach permanently, recording its ID in the event
+func releaseFailed(docID string, data []byte, msg mail.Message, sender string, event *releaseEvent, sendErr error) {
+	if !config.DSN {
+		return
+	}
+	// never bounce automatic mail such as other bounces
+	if auto := msg.Header.Get("Auto-Submitted"); auto != "" && !strings.EqualFold(auto, "no") {
+		return
+	}
+	permanent := make(deliveryError, 0)
+	for _, f := range recipientFailures(*event, sendErr) {
+		if isPermanentFailure(f.Err) {
+			permanent = append(permanent, f)
+		}
+	}
+	if len(permanent) == 0 {
+		return
+	}
+	dsnID, err := bounceMessage(docID, data, msg, sender, permanent, *event)
+	if err != nil {
+		log.Printf("Error generating DSN for mail ID %s: %s\n", docID, err)
+		return
+	}
+	event.DSN = dsnID
+}
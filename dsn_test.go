@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBounce(t *testing.T) {
+	config.DSN = true
+	f, _ := mockSend(&textproto.Error{Code: 550, Msg: "5.1.1 <to@example.com>: User unknown"})
+	mailSender = &emailSender{send: f}
+	defer func() {
+		config.DSN = false
+		f, _ := mockSend(nil)
+		mailSender = &emailSender{send: f}
+	}()
+
+	msg, err := mail.ReadMessage(strings.NewReader(emailStr))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	id := fmt.Sprintf("%v", time.Now().UnixNano())
+	doc := bleveDoc{Type: "message", Header: msg.Header, Recipients: []string{"to@example.com"}}
+	if err := msgStore.Put(id, []byte(emailStr)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := index.Index(id, doc); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if _, err = sendMailDoc(id, releaseActor{Name: "test"}); err == nil {
+		t.Fatalf("expected release to fail")
+	}
+
+	history, err := loadHistory(id)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(history) != 1 || history[0].DSN == "" {
+		t.Fatalf("expected release history to reference a DSN, got %+v", history)
+	}
+
+	dsn, _, err := getDoc(history[0].DSN)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if dsn.BounceOf != id {
+		t.Errorf("expected DSN to be linked to %s, got '%s'", id, dsn.BounceOf)
+	}
+	if dsn.Recipients[0] != "from@example.com" {
+		t.Errorf("expected DSN to be addressed to the sender, got %v", dsn.Recipients)
+	}
+	raw, err := msgStore.Get(history[0].DSN)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, s := range []string{"report-type=delivery-status", "Status: 5.1.1", "Final-Recipient: rfc822; to@example.com"} {
+		if !strings.Contains(string(raw), s) {
+			t.Errorf("expected DSN to contain '%s'", s)
+		}
+	}
+}
+
+func TestBounceVERP(t *testing.T) {
+	config.DSN = true
+	config.ReturnPath = "bounces@example.org"
+	config.ReturnPathVERP = true
+	sent := make([]string, 0)
+	mailSender = &emailSender{send: func(addr string, a smtp.Auth, from string, to []string, msg []byte) (string, error) {
+		if to[0] == "bad@example.com" {
+			return "", &textproto.Error{Code: 550, Msg: "5.1.1 <bad@example.com>: User unknown"}
+		}
+		sent = append(sent, to...)
+		return "250 OK", nil
+	}}
+	defer func() {
+		config.DSN = false
+		config.ReturnPath = ""
+		config.ReturnPathVERP = false
+		f, _ := mockSend(nil)
+		mailSender = &emailSender{send: f}
+	}()
+
+	msg, err := mail.ReadMessage(strings.NewReader(emailStr))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	id := fmt.Sprintf("%v", time.Now().UnixNano())
+	doc := bleveDoc{Type: "message", Header: msg.Header, Recipients: []string{"good@example.com", "bad@example.com"}}
+	if err := msgStore.Put(id, []byte(emailStr)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := index.Index(id, doc); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if _, err = sendMailDoc(id, releaseActor{Name: "test"}); err == nil {
+		t.Fatalf("expected release to fail")
+	}
+	history, err := loadHistory(id)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(history) != 1 || len(history[0].Failed) != 1 || history[0].Failed[0] != "bad@example.com" || history[0].DSN == "" {
+		t.Fatalf("expected only bad@example.com to fail, got %+v", history)
+	}
+	raw, err := msgStore.Get(history[0].DSN)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !strings.Contains(string(raw), "Final-Recipient: rfc822; bad@example.com") || strings.Contains(string(raw), "good@example.com") {
+		t.Errorf("expected DSN to list only the failed recipient:\n%s", raw)
+	}
+
+	// the retry only goes to the recipient which failed
+	mailSender = &emailSender{send: func(addr string, a smtp.Auth, from string, to []string, msg []byte) (string, error) {
+		sent = append(sent, to...)
+		return "250 OK", nil
+	}}
+	if _, err = sendMailDoc(id, releaseActor{Name: "test"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(sent) != 2 || sent[0] != "good@example.com" || sent[1] != "bad@example.com" {
+		t.Errorf("expected each recipient to be sent one copy, got %v", sent)
+	}
+	doc, _, err = getDoc(id)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if doc.Delivered.IsZero() {
+		t.Errorf("expected mail to be delivered after the retry")
+	}
+}
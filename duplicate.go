@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search/query"
+)
+
+type DuplicatesHandler struct{}
+
+// DuplicateGroup is a message and the later copies of it
+type DuplicateGroup struct {
+	ID         string
+	Subject    string
+	Duplicates []string
+}
+
+type DuplicatesResult struct {
+	Total  int
+	Groups []DuplicateGroup
+}
+
+// fingerprint identifies the content of a message, from its subject,
+// recipients and text. Headers which differ between sends of the same
+// message, such as Date and Message-ID, are ignored.
+func fingerprint(doc bleveDoc) string {
+	recipients := make([]string, 0, len(doc.Recipients))
+	for _, r := range doc.Recipients {
+		recipients = append(recipients, strings.ToLower(r))
+	}
+	sort.Strings(recipients)
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s",
+		strings.Join(strings.Fields(doc.Header.Get("Subject")), " "),
+		strings.Join(recipients, ","),
+		strings.Join(strings.Fields(doc.Body), " "))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// flagDuplicate marks a new message as a duplicate of the first message with
+// the same fingerprint received within the duplicate window before it
+func flagDuplicate(doc *bleveDoc) error {
+	window := config.DuplicateWindow.Duration
+	if window <= 0 {
+		return nil
+	}
+
+	fpQuery := query.NewTermQuery(doc.Fingerprint)
+	fpQuery.SetField("Fingerprint")
+	receivedQuery := query.NewDateRangeQuery(doc.Received.Add(-window), doc.Received)
+	receivedQuery.SetField("Received")
+
+	bRequest := bleve.NewSearchRequestOptions(query.NewConjunctionQuery([]query.Query{fpQuery, receivedQuery}), 1, 0, false)
+	bRequest.SortBy([]string{"Received"})
+	bRequest.Fields = []string{"DuplicateOf"}
+	searchResult, err := index.Search(bRequest)
+	if err != nil {
+		return fmt.Errorf("error executing query: %v", err)
+	}
+	if len(searchResult.Hits) > 0 {
+		hit := searchResult.Hits[0]
+		doc.DuplicateOf = fieldString(hit.Fields["DuplicateOf"])
+		if doc.DuplicateOf == "" {
+			doc.DuplicateOf = hit.ID
+		}
+	}
+	return nil
+}
+
+// duplicateQuery matches messages which are (true) or aren't (false)
+// duplicates
+func duplicateQuery(duplicate bool) query.Query {
+	// documents which aren't duplicates index an empty DuplicateOf
+	dupQuery := query.NewRegexpQuery(".+")
+	dupQuery.SetField("DuplicateOf")
+	if duplicate {
+		return dupQuery
+	}
+	return query.NewBooleanQuery([]query.Query{query.NewMatchAllQuery()}, nil, []query.Query{dupQuery})
+}
+
+// duplicateGroups groups duplicate messages by the message they copy, most
+// recently duplicated first
+func duplicateGroups() ([]DuplicateGroup, error) {
+	groups := make([]DuplicateGroup, 0)
+	seen := make(map[string]int)
+	for offset := 0; ; offset += bulkPageSize {
+		bRequest := bleve.NewSearchRequestOptions(duplicateQuery(true), bulkPageSize, offset, false)
+		bRequest.SortBy([]string{"-Received", "_id"})
+		bRequest.Fields = []string{"DuplicateOf", "Header.Subject"}
+
+		searchResult, err := index.Search(bRequest)
+		if err != nil {
+			return nil, fmt.Errorf("error executing query: %v", err)
+		}
+		for _, hit := range searchResult.Hits {
+			original := fieldString(hit.Fields["DuplicateOf"])
+			i, ok := seen[original]
+			if !ok {
+				i = len(groups)
+				seen[original] = i
+				groups = append(groups, DuplicateGroup{ID: original, Subject: fieldString(hit.Fields["Header.Subject"])})
+			}
+			groups[i].Duplicates = append(groups[i].Duplicates, hit.ID)
+		}
+		if len(searchResult.Hits) < bulkPageSize {
+			break
+		}
+	}
+	return groups, nil
+}
+
+// DuplicatesHandler lists messages which have been sent more than once
+func (h *DuplicatesHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	groups, err := duplicateGroups()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), 500)
+		return
+	}
+	mustEncode(w, DuplicatesResult{Total: len(groups), Groups: groups})
+}
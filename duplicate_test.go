@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"testing"
+	"time"
+)
+
+func dupMsg(msgID, body string) []byte {
+	return []byte(fmt.Sprintf("Message-ID: <%s>\r\nDate: %s\r\nSubject: Your receipt\r\nFrom: shop@example.com\r\nTo: dup@example.com\r\n\r\n%s\r\n", msgID, time.Now().Format(RFC1123ZnoPadDay), body))
+}
+
+func TestFingerprint(t *testing.T) {
+	doc := bleveDoc{
+		Header:     mail.Header{"Subject": {"Your  receipt"}, "Date": {"Mon, 2 Jan 2006 15:04:05 -0700"}},
+		Recipients: []string{"b@example.com", "A@example.com"},
+		Body:       "Thanks for\r\nyour order",
+	}
+	same := bleveDoc{
+		Header:     mail.Header{"Subject": {"Your receipt"}, "Date": {"Tue, 3 Jan 2006 15:04:05 -0700"}, "Message-Id": {"<other@example.com>"}},
+		Recipients: []string{"a@example.com", "b@example.com"},
+		Body:       "Thanks for your order\n",
+	}
+	if fingerprint(doc) != fingerprint(same) {
+		t.Error("expected messages differing only in volatile headers and whitespace to have the same fingerprint")
+	}
+	same.Recipients = []string{"a@example.com"}
+	if fingerprint(doc) == fingerprint(same) {
+		t.Error("expected messages to different recipients to have different fingerprints")
+	}
+}
+
+func TestDuplicates(t *testing.T) {
+	defer purge("dup@example.com")
+	defer func(window duration) { config.DuplicateWindow = window }(config.DuplicateWindow)
+	config.DuplicateWindow = duration{10 * time.Minute}
+
+	for i, body := range []string{"Thanks for your order", "Thanks for your order", "Thanks for your other order", "Thanks for your order"} {
+		if err := handleMessage(nil, "shop@example.com", []string{"dup@example.com"}, dupMsg(fmt.Sprintf("dup%d@example.com", i), body)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	ids := make([]string, 4)
+	for i := range ids {
+		var err error
+		if ids[i], err = messageIDDoc(fmt.Sprintf("dup%d@example.com", i)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	count := func(request SearchRequest) int {
+		request.Address = map[string]string{"To": "dup@example.com"}
+		bQuery, err := buildQuery(request)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		docs, err := matchingDocs(bQuery)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return len(docs)
+	}
+	yes, no := true, false
+	if n := count(SearchRequest{Duplicate: &yes}); n != 2 {
+		t.Errorf("expected 2 duplicates, got %d", n)
+	}
+	if n := count(SearchRequest{Duplicate: &no}); n != 2 {
+		t.Errorf("expected 2 originals, got %d", n)
+	}
+	if n := count(SearchRequest{DuplicateOf: ids[0]}); n != 2 {
+		t.Errorf("expected 2 copies of the first message, got %d", n)
+	}
+
+	w := httptest.NewRecorder()
+	(&DuplicatesHandler{}).ServeHTTP(w, httptest.NewRequest("GET", "/api/duplicates", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	var result DuplicatesResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if result.Total != 1 {
+		t.Fatalf("expected 1 duplicate group, got %s", w.Body.String())
+	}
+	group := result.Groups[0]
+	if group.ID != ids[0] || group.Subject != "Your receipt" || len(group.Duplicates) != 2 {
+		t.Errorf("unexpected group %+v", group)
+	}
+
+	// outside the window
+	config.DuplicateWindow = duration{time.Nanosecond}
+	if err := handleMessage(nil, "shop@example.com", []string{"dup@example.com"}, dupMsg("dup4@example.com", "Thanks for your order")); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := count(SearchRequest{DuplicateOf: ids[0]}); n != 2 {
+		t.Errorf("expected a copy outside the window not to be flagged, got %d copies", n)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	exportMbox = "mbox"
+	exportZip  = "zip"
+	exportJSON = "json"
+)
+
+// date layout of mbox 'From ' separator lines
+const mboxDateLayout = "Mon Jan _2 15:04:05 2006"
+
+// lines needing an extra '>' to be distinguished from mbox separators
+var mboxFromRe = regexp.MustCompile(`^>*From `)
+
+var exportSearch = flag.String("search", "", "JSON search request selecting the messages to export")
+
+type ExportHandler struct{}
+
+// ExportRequest selects messages with the same fields as SearchRequest. Limit
+// and Offset are ignored: every match is exported.
+type ExportRequest struct {
+	SearchRequest
+	// mbox, zip or json
+	Format string
+}
+
+// exportRecord is one line of a JSON export
+type exportRecord struct {
+	ID          string
+	Header      mail.Header
+	Sender      string
+	Recipients  []string
+	Received    time.Time
+	Delivered   *time.Time `json:",omitempty"`
+	Size        int
+	ClientIP    string       `json:",omitempty"`
+	Auth        *authResults `json:",omitempty"`
+	Tags        []string     `json:",omitempty"`
+	Attachments []attachment `json:",omitempty"`
+	BounceOf    string       `json:",omitempty"`
+	Raw         string
+}
+
+// exportWriter writes messages to an archive
+type exportWriter interface {
+	Write(id string, doc bleveDoc, raw []byte) error
+	Close() error
+}
+
+type exportFormat struct {
+	ContentType string
+	Extension   string
+	newWriter   func(io.Writer) exportWriter
+}
+
+var exportFormats = map[string]exportFormat{
+	exportMbox: {"application/mbox", ".mbox", func(w io.Writer) exportWriter { return &mboxWriter{w: w} }},
+	exportZip:  {"application/zip", ".zip", func(w io.Writer) exportWriter { return &zipWriter{zw: zip.NewWriter(w)} }},
+	exportJSON: {"application/x-ndjson", ".json", func(w io.Writer) exportWriter { return &jsonWriter{enc: json.NewEncoder(w)} }},
+}
+
+func (h *ExportHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	// read the request body
+	requestBody, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error reading request body: %v", err), 400)
+		return
+	}
+
+	// parse the request
+	var exportRequest ExportRequest
+	err = json.Unmarshal(requestBody, &exportRequest)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error parsing request: %v", err), 400)
+		return
+	}
+	if exportRequest.Format == "" {
+		exportRequest.Format = exportMbox
+	}
+	format, ok := exportFormats[exportRequest.Format]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown export format '%s'", exportRequest.Format), 400)
+		return
+	}
+
+	ids, err := exportIDs(exportRequest.SearchRequest)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), 400)
+		return
+	}
+
+	w.Header().Set("Content-Type", format.ContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s-export%s\"", appName, format.Extension))
+	// the response has started, so errors can only be logged
+	if _, err = exportMessages(w, exportRequest.Format, ids); err != nil {
+		log.Printf("Error exporting messages: %s\n", err)
+	}
+}
+
+// exportIDs returns the IDs of the messages matching a search
+func exportIDs(searchRequest SearchRequest) ([]string, error) {
+	bQuery, err := buildQuery(searchRequest)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := matchingDocs(bQuery)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(docs))
+	for _, doc := range docs {
+		ids = append(ids, doc.ID)
+	}
+	return ids, nil
+}
+
+// exportMessages writes the given messages to w in an export format,
+// returning the number written
+func exportMessages(w io.Writer, format string, ids []string) (int, error) {
+	f, ok := exportFormats[format]
+	if !ok {
+		return 0, fmt.Errorf("unknown export format '%s'", format)
+	}
+	ew := f.newWriter(w)
+
+	count := 0
+	for _, id := range ids {
+		doc, _, err := getDoc(id)
+		if err != nil {
+			return count, err
+		}
+		raw, err := msgStore.Get(id)
+		if err != nil {
+			return count, fmt.Errorf("error retrieving mail with ID %s: %v", id, err)
+		}
+		if err = ew.Write(id, doc, raw); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, ew.Close()
+}
+
+// mboxWriter writes the mboxrd format
+type mboxWriter struct {
+	w io.Writer
+}
+
+func (m *mboxWriter) Write(id string, doc bleveDoc, raw []byte) error {
+	sender := envelopeSender(doc)
+	if sender == "" {
+		sender = "MAILER-DAEMON"
+	}
+	received := doc.Received
+	if received.IsZero() {
+		received = time.Now()
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From %s %s\n", sender, received.UTC().Format(mboxDateLayout))
+	lines := strings.Split(strings.Replace(string(raw), "\r\n", "\n", -1), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	for _, line := range lines {
+		if mboxFromRe.MatchString(line) {
+			buf.WriteString(">")
+		}
+		buf.WriteString(line)
+		buf.WriteString("\n")
+	}
+	buf.WriteString("\n")
+
+	_, err := m.w.Write(buf.Bytes())
+	return err
+}
+
+func (m *mboxWriter) Close() error {
+	return nil
+}
+
+// zipWriter writes each message as <ID>.eml in a zip archive
+type zipWriter struct {
+	zw *zip.Writer
+}
+
+func (z *zipWriter) Write(id string, doc bleveDoc, raw []byte) error {
+	modified := doc.Received
+	if modified.IsZero() {
+		modified = time.Now()
+	}
+	f, err := z.zw.CreateHeader(&zip.FileHeader{Name: id + ".eml", Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(raw)
+	return err
+}
+
+func (z *zipWriter) Close() error {
+	return z.zw.Close()
+}
+
+// jsonWriter writes one exportRecord per line
+type jsonWriter struct {
+	enc *json.Encoder
+}
+
+func (j *jsonWriter) Write(id string, doc bleveDoc, raw []byte) error {
+	record := exportRecord{
+		ID:          id,
+		Header:      doc.Header,
+		Sender:      doc.Sender,
+		Recipients:  doc.Recipients,
+		Received:    doc.Received,
+		Size:        doc.Size,
+		ClientIP:    doc.ClientIP,
+		Tags:        doc.Tags,
+		Attachments: doc.Attachments,
+		BounceOf:    doc.BounceOf,
+		Raw:         string(raw),
+	}
+	if !doc.Delivered.IsZero() {
+		record.Delivered = &doc.Delivered
+	}
+	if doc.Auth.DKIM != "" {
+		record.Auth = &doc.Auth
+	}
+	return j.enc.Encode(record)
+}
+
+func (j *jsonWriter) Close() error {
+	return nil
+}
+
+// exportCommand writes the messages matching -search to the file named by
+// the first argument. The format is taken from its extension.
+func exportCommand(indexDir string) error {
+	if flag.NArg() != 1 {
+		return fmt.Errorf("usage: %s export -c config.toml [-search '{\"Tags\": [\"bug-123\"]}'] file.mbox|file.zip|file.json", appName)
+	}
+	path := flag.Arg(0)
+
+	format := ""
+	for name, f := range exportFormats {
+		if strings.EqualFold(filepath.Ext(path), f.Extension) {
+			format = name
+		}
+	}
+	if format == "" {
+		return fmt.Errorf("can't tell the export format of '%s'. Use a .mbox, .zip or .json extension", path)
+	}
+
+	var searchRequest SearchRequest
+	if *exportSearch != "" {
+		if err := json.Unmarshal([]byte(*exportSearch), &searchRequest); err != nil {
+			return fmt.Errorf("error parsing search: %v", err)
+		}
+	}
+
+	if err := openStorage(indexDir); err != nil {
+		return err
+	}
+	defer closeStorage()
+
+	ids, err := exportIDs(searchRequest)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	count, err := exportMessages(f, format, ids)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("error exporting messages: %s", err)
+	}
+	fmt.Printf("Exported %d messages to '%s'\n", count, path)
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	const fromLine = "\nFrom the desk of\n>From here\n"
+	raw := strings.Replace(emailStr, "\ntest message", "\ntest message"+fromLine, 1)
+	if err := handleMessage(nil, "from@example.com", []string{"export@example.com"}, []byte(raw)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	ids, err := exportIDs(SearchRequest{Query: "export@example.com", Locations: []string{"To"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var id string
+	for _, i := range ids {
+		if doc, _, err := getDoc(i); err == nil && doc.Recipients[0] == "export@example.com" {
+			id = i
+		}
+	}
+	if id == "" {
+		t.Fatalf("exported message not found")
+	}
+
+	var buf bytes.Buffer
+	if _, err = exportMessages(&buf, exportMbox, []string{id}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	mbox := buf.String()
+	if !strings.HasPrefix(mbox, "From from@example.com ") {
+		t.Errorf("expected mbox separator line, got '%s'", mbox)
+	}
+	if !strings.Contains(mbox, "\n>From the desk of\n>>From here\n") {
+		t.Errorf("expected From lines to be quoted, got '%s'", mbox)
+	}
+
+	buf.Reset()
+	if _, err = exportMessages(&buf, exportZip, []string{id}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(zr.File) != 1 || zr.File[0].Name != id+".eml" {
+		t.Fatalf("unexpected zip contents %v", zr.File)
+	}
+	rc, _ := zr.File[0].Open()
+	eml, _ := ioutil.ReadAll(rc)
+	rc.Close()
+	if string(eml) != raw {
+		t.Errorf("expected raw message in zip, got '%s'", eml)
+	}
+
+	// JSON export through the HTTP handler
+	body := `{"Format": "json", "Query": "export@example.com", "Locations": ["To"]}`
+	w := httptest.NewRecorder()
+	(&ExportHandler{}).ServeHTTP(w, httptest.NewRequest("POST", "/api/export", strings.NewReader(body)))
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("unexpected content type '%s'", ct)
+	}
+	found := false
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var record exportRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if record.ID == id {
+			found = true
+			if record.Raw != raw || record.Sender != "from@example.com" || record.Header.Get("Subject") != "test subject" {
+				t.Errorf("unexpected record %+v", record)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("expected message in JSON export")
+	}
+
+	w = httptest.NewRecorder()
+	(&ExportHandler{}).ServeHTTP(w, httptest.NewRequest("POST", "/api/export", strings.NewReader(`{"Format": "pdf"}`)))
+	if w.Code != 400 {
+		t.Errorf("expected unknown format to return 400, got %d", w.Code)
+	}
+}
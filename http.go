@@ -28,6 +28,7 @@ const SearchPrefixLen = 3
 const SearchFuzziness = 2
 
 type MailHandler struct{}
+type DKIMHandler struct{}
 type SearchDocHandler struct{}
 type SearchHandler struct{}
 
@@ -41,35 +42,103 @@ type SearchRequest struct {
 	Locations []string
 	StartTime time.Time
 	EndTime   time.Time
+	// filter on authentication results e.g. {"SPF": "pass"}
+	Auth map[string]string
+	// only match messages having all of these tags
+	Tags []string
+	// filter on release history e.g. {"Actor": "alice"}
+	History map[string]string
+	// only match messages with (true) or without (false) attachments
+	HasAttachment *bool
+	// match attachments by filename, or content type e.g. "image/*"
+	Filename    string
+	ContentType string
+	// exact, case insensitive address and domain filters on the From, To or
+	// Cc header, or "Any" of them e.g. {"To": "bob@example.com"}
+	Address map[string]string
+	Domain  map[string]string
+	// return the most common domains of each address header, up to this many
+	DomainFacets int
+	// only match messages which have (true) or haven't (false) been seen or
+	// starred, and which have all of these labels
+	Seen    *bool
+	Starred *bool
+	Labels  []string
+	// only match messages with a note by this author
+	NoteAuthor string
+	// only match messages which are (true) or aren't (false) duplicates of
+	// an earlier message, copies of the message with this ID, or messages
+	// with this content fingerprint
+	Duplicate   *bool
+	DuplicateOf string
+	Fingerprint string
+	// list one message per thread, the newest matching, with Total counting
+	// threads
+	Threaded bool
 }
 
 type SearchResult struct {
-	Total  uint64
-	Offset int
-	Emails []Email
+	Total   uint64
+	Offset  int
+	Emails  []Email
+	Domains map[string][]DomainCount `json:",omitempty"`
 }
 
 type MailResult struct {
 	Success bool
 }
 
+type DKIMResult struct {
+	Domain   string
+	Selector string
+	Header   string
+}
+
 type Email struct {
-	ID        string
-	Header    mail.Header
-	Body      string
-	Delivered *time.Time `json:"Delivered,omitempty"`
+	ID              string
+	Header          mail.Header
+	Body            string
+	Delivered       *time.Time   `json:"Delivered,omitempty"`
+	Auth            *authResults `json:"Auth,omitempty"`
+	Tags            []string     `json:"Tags,omitempty"`
+	AttachmentCount int          `json:"AttachmentCount,omitempty"`
+	Seen            bool
+	Starred         bool
+	Labels          []string `json:"Labels,omitempty"`
+	ThreadID        string
+	// matching messages in the thread, in threaded searches
+	ThreadCount int    `json:"ThreadCount,omitempty"`
+	DuplicateOf string `json:"DuplicateOf,omitempty"`
+	// only listed when fetching a single message
+	Attachments []attachment `json:"Attachments,omitempty"`
+	Notes       []note       `json:"Notes,omitempty"`
 }
 
 func httpServer() {
 	// create a router to serve static files
 	router := staticFileRouter()
 
-	// add the API
+	// add the API. The unversioned routes are kept for existing clients
 	bleveHttp.RegisterIndexName(appName, index)
-	router.Handle("/api/search", &SearchHandler{}).Methods("POST")
-	router.Handle("/api/search/{docID}", &SearchDocHandler{}).Methods("GET")
-	router.Handle("/api/mail/{docID}", &MailHandler{}).Methods("GET")
-	router.Handle("/api/list", &SearchHandler{}).Methods("POST")
+	registerAPIv1(router)
+	router.Handle("/api/search", deprecated(&SearchHandler{})).Methods("POST")
+	router.Handle("/api/search/{docID}", deprecated(&SearchDocHandler{})).Methods("GET")
+	router.Handle("/api/mail/{docID}", deprecated(&MailHandler{})).Methods("GET")
+	router.Handle("/api/list", deprecated(&SearchHandler{})).Methods("POST")
+	router.Handle("/api/dkim/{docID}", deprecated(&DKIMHandler{})).Methods("GET")
+	router.Handle("/api/bulk/{action}", deprecated(&BulkHandler{})).Methods("POST")
+	router.Handle("/api/queue", deprecated(&QueueHandler{})).Methods("GET")
+	router.Handle("/api/messages/{docID}/history", deprecated(&HistoryHandler{})).Methods("GET")
+	router.Handle("/api/messages/{docID}/state", deprecated(&StateHandler{})).Methods("GET", "PATCH")
+	router.Handle("/api/messages/{docID}/notes", deprecated(&NotesHandler{})).Methods("GET", "POST")
+	router.Handle("/api/threads/{threadID}", deprecated(&ThreadHandler{})).Methods("GET")
+	router.Handle("/api/duplicates", deprecated(&DuplicatesHandler{})).Methods("GET")
+	router.Handle("/api/messages/{docID}", deprecated(&DeleteHandler{})).Methods("DELETE")
+	router.Handle("/api/messages", deprecated(&PurgeHandler{})).Methods("DELETE")
+	router.Handle("/api/delete", deprecated(&DeleteQueryHandler{})).Methods("POST")
+	router.Handle("/api/export", deprecated(&ExportHandler{})).Methods("POST")
+	router.Handle("/api/import", deprecated(&ImportHandler{})).Methods("POST")
+	router.Handle("/api/backup", deprecated(&BackupHandler{})).Methods("GET")
 	listFieldsHandler := bleveHttp.NewListFieldsHandler(appName)
 	router.Handle("/api/fields", listFieldsHandler).Methods("GET")
 	listIndexesHandler := bleveHttp.NewListIndexesHandler()
@@ -114,6 +183,75 @@ func (h *SearchHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	result, httpStatus, err := searchMessages(searchRequest)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), httpStatus)
+		return
+	}
+	mustEncode(w, result)
+}
+
+// searchMessages returns a page of the messages matching a search, newest
+// first
+func searchMessages(searchRequest SearchRequest) (SearchResult, int, error) {
+	var result SearchResult
+	bQuery, err := buildQuery(searchRequest)
+	if err != nil {
+		return result, 400, err
+	}
+
+	bSearchRequest := bleve.NewSearchRequest(bQuery)
+	bSearchRequest.SortBy([]string{"-Header.Date"})
+	bSearchRequest.Fields = []string{"*"}
+	bSearchRequest.From = searchRequest.Offset
+
+	switch {
+	case searchRequest.Limit > ResultLimit:
+		return result, 400, fmt.Errorf("request limit of %d is greater than max allowed limit of %d", searchRequest.Limit, ResultLimit)
+	case searchRequest.Limit > 0:
+		bSearchRequest.Size = searchRequest.Limit
+	default:
+		bSearchRequest.Size = ResultLimit
+	}
+	if searchRequest.DomainFacets > 0 {
+		addDomainFacets(bSearchRequest, searchRequest.DomainFacets)
+	}
+
+	if searchRequest.Threaded {
+		result, err = threadedSearch(searchRequest, bQuery, bSearchRequest.Size)
+		if err == nil && searchRequest.DomainFacets > 0 {
+			// facets count messages rather than threads
+			bSearchRequest.Size = 0
+			var facetResult SearchResult
+			facetResult, err = doSearch(searchRequest, bSearchRequest, false)
+			result.Domains = facetResult.Domains
+		}
+	} else {
+		result, err = doSearch(searchRequest, bSearchRequest, false)
+	}
+	if err != nil {
+		return result, 500, err
+	}
+
+	result.Offset = searchRequest.Offset
+	return result, 200, nil
+}
+
+// locationField returns the index field searched for a location: a header
+// name, Body for the message text or Notes for the text of notes
+func locationField(location string) string {
+	switch location {
+	case bodyLocation:
+		return bodyLocation
+	case notesLocation:
+		return notesLocation + ".Text"
+	}
+	return locationsBase + location
+}
+
+// buildQuery converts a SearchRequest into a bleve query. Errors are the
+// result of invalid requests.
+func buildQuery(searchRequest SearchRequest) (query.Query, error) {
 	var bQuery query.Query
 	var matchQuery query.Query
 
@@ -131,19 +269,18 @@ func (h *SearchHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			if strings.Contains(searchRequest.Query, " ") {
 				tmpQuery := query.NewMatchPhraseQuery(searchRequest.Query)
 				if location != "" {
-					tmpQuery.SetField(locationsBase + location)
+					tmpQuery.SetField(locationField(location))
 				}
 				matchQuery = tmpQuery
 			} else {
 				if utf8.RuneCountInString(searchRequest.Query) <= SearchPrefixLen {
-					http.Error(w, fmt.Sprintf("query string too short"), 400)
-					return
+					return nil, fmt.Errorf("query string too short")
 				}
 				tmpQuery := query.NewMatchQuery(searchRequest.Query)
 				tmpQuery.SetFuzziness(SearchFuzziness)
 				tmpQuery.SetPrefix(SearchPrefixLen)
 				if location != "" {
-					tmpQuery.SetField(locationsBase + location)
+					tmpQuery.SetField(locationField(location))
 				}
 				matchQuery = tmpQuery
 			}
@@ -153,67 +290,139 @@ func (h *SearchHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 		matchQuery = query.NewDisjunctionQuery(locQueries)
 	}
 
+	conjuncts := []query.Query{matchQuery}
 	if !searchRequest.StartTime.IsZero() || !searchRequest.EndTime.IsZero() {
 		dateTimeQuery := query.NewDateRangeQuery(
 			searchRequest.StartTime,
 			searchRequest.EndTime,
 		)
-		bQuery = query.NewConjunctionQuery([]query.Query{matchQuery, dateTimeQuery})
-	} else {
-		bQuery = matchQuery
+		conjuncts = append(conjuncts, dateTimeQuery)
+	}
+	for field, value := range searchRequest.Auth {
+		switch field {
+		case "DKIM", "DKIMDomains", "SPF", "ARC":
+		default:
+			return nil, fmt.Errorf("invalid auth field '%s'", field)
+		}
+		authQuery := query.NewTermQuery(value)
+		authQuery.SetField("Auth." + field)
+		conjuncts = append(conjuncts, authQuery)
+	}
+	for field, value := range searchRequest.History {
+		switch field {
+		case "Actor", "RemoteAddr", "Recipients", "Transport":
+		default:
+			return nil, fmt.Errorf("invalid history field '%s'", field)
+		}
+		historyQuery := query.NewTermQuery(value)
+		historyQuery.SetField("History." + field)
+		conjuncts = append(conjuncts, historyQuery)
+	}
+	for _, tag := range searchRequest.Tags {
+		tagQuery := query.NewTermQuery(tag)
+		tagQuery.SetField("Tags")
+		conjuncts = append(conjuncts, tagQuery)
+	}
+	if searchRequest.HasAttachment != nil {
+		one := 1.0
+		inclusive := true
+		countQuery := query.NewNumericRangeInclusiveQuery(nil, &one, nil, nil)
+		if *searchRequest.HasAttachment {
+			countQuery = query.NewNumericRangeInclusiveQuery(&one, nil, &inclusive, nil)
+		}
+		countQuery.SetField("AttachmentCount")
+		conjuncts = append(conjuncts, countQuery)
+	}
+	if searchRequest.Filename != "" {
+		filenameQuery := query.NewMatchPhraseQuery(searchRequest.Filename)
+		filenameQuery.SetField("Attachments.Filename")
+		conjuncts = append(conjuncts, filenameQuery)
+	}
+	if searchRequest.ContentType != "" {
+		typeQuery := query.NewWildcardQuery(strings.ToLower(searchRequest.ContentType))
+		typeQuery.SetField("Attachments.ContentType")
+		conjuncts = append(conjuncts, typeQuery)
+	}
+	if searchRequest.Seen != nil {
+		conjuncts = append(conjuncts, stateFlagQuery("Seen", *searchRequest.Seen))
+	}
+	if searchRequest.Starred != nil {
+		conjuncts = append(conjuncts, stateFlagQuery("Starred", *searchRequest.Starred))
+	}
+	for _, label := range searchRequest.Labels {
+		labelQuery := query.NewTermQuery(strings.TrimSpace(label))
+		labelQuery.SetField("State.Labels")
+		conjuncts = append(conjuncts, labelQuery)
+	}
+	if searchRequest.Duplicate != nil {
+		conjuncts = append(conjuncts, duplicateQuery(*searchRequest.Duplicate))
+	}
+	if searchRequest.DuplicateOf != "" {
+		dupQuery := query.NewTermQuery(searchRequest.DuplicateOf)
+		dupQuery.SetField("DuplicateOf")
+		conjuncts = append(conjuncts, dupQuery)
+	}
+	if searchRequest.Fingerprint != "" {
+		fpQuery := query.NewTermQuery(searchRequest.Fingerprint)
+		fpQuery.SetField("Fingerprint")
+		conjuncts = append(conjuncts, fpQuery)
+	}
+	if searchRequest.NoteAuthor != "" {
+		authorQuery := query.NewTermQuery(searchRequest.NoteAuthor)
+		authorQuery.SetField("Notes.Author")
+		conjuncts = append(conjuncts, authorQuery)
+	}
+	for header, address := range searchRequest.Address {
+		addrQuery, err := addressQuery(header, "Address", address)
+		if err != nil {
+			return nil, err
+		}
+		conjuncts = append(conjuncts, addrQuery)
+	}
+	for header, domain := range searchRequest.Domain {
+		domainQuery, err := addressQuery(header, "Domain", domain)
+		if err != nil {
+			return nil, err
+		}
+		conjuncts = append(conjuncts, domainQuery)
 	}
 
-	bSearchRequest := bleve.NewSearchRequest(bQuery)
-	bSearchRequest.SortBy([]string{"-Header.Date"})
-	bSearchRequest.Fields = []string{"Data", "Delivered"}
-	bSearchRequest.From = searchRequest.Offset
-
-	switch {
-	case searchRequest.Limit > ResultLimit:
-		http.Error(w, fmt.Sprintf("request limit of %d is greater than max allowed limit of %d", searchRequest.Limit, ResultLimit), 400)
-		return
-	case searchRequest.Limit > 0:
-		bSearchRequest.Size = searchRequest.Limit
-	default:
-		bSearchRequest.Size = ResultLimit
+	if len(conjuncts) > 1 {
+		bQuery = query.NewConjunctionQuery(conjuncts)
+	} else {
+		bQuery = matchQuery
 	}
 
 	// validate the query
-	if srqv, ok := bSearchRequest.Query.(query.ValidatableQuery); ok {
-		err = srqv.Validate()
-		if err != nil {
-			http.Error(w, fmt.Sprintf("error validating query: %v", err), 400)
-			return
+	if srqv, ok := bQuery.(query.ValidatableQuery); ok {
+		if err := srqv.Validate(); err != nil {
+			return nil, fmt.Errorf("error validating query: %v", err)
 		}
 	}
 
-	var result SearchResult
-	result, err = doSearch(searchRequest, bSearchRequest, false)
+	return bQuery, nil
+}
+
+func (h *SearchDocHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	docID := mux.Vars(req)["docID"]
+
+	result, err := searchDoc(docID)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("%s", err), 500)
 		return
 	}
-
-	result.Offset = searchRequest.Offset
 	mustEncode(w, result)
 }
 
-func (h *SearchDocHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	var err error
-	docID := mux.Vars(req)["docID"]
-
+// searchDoc returns a single message with its body, or no messages if it
+// doesn't exist
+func searchDoc(docID string) (SearchResult, error) {
 	docQuery := query.NewDocIDQuery([]string{docID})
 
 	bSearchRequest := bleve.NewSearchRequest(docQuery)
-	bSearchRequest.Fields = []string{"Data", "Delivered"}
+	bSearchRequest.Fields = []string{"Delivered", "Auth.DKIM", "Auth.DKIMDomains", "Auth.SPF", "Auth.ARC", "Tags", "State.Seen", "State.Starred", "State.Labels", "ThreadID", "DuplicateOf"}
 
-	var result SearchResult
-	result, err = doSearch(SearchRequest{}, bSearchRequest, true)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("%s", err), 500)
-		return
-	}
-	mustEncode(w, result)
+	return doSearch(SearchRequest{}, bSearchRequest, true)
 }
 
 func (h *MailHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
@@ -221,7 +430,7 @@ func (h *MailHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	var httpStatus int
 	docID := mux.Vars(req)["docID"]
 
-	httpStatus, err = sendMailDoc(docID)
+	httpStatus, err = sendMailDoc(docID, requestActor(req))
 	if err != nil {
 		http.Error(w, fmt.Sprintf("%s", err), httpStatus)
 		return
@@ -233,6 +442,34 @@ func (h *MailHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	mustEncode(w, result)
 }
 
+// DKIMHandler returns the DKIM-Signature header that would be applied if the
+// message were released now. Nothing is sent.
+func (h *DKIMHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	docID := mux.Vars(req)["docID"]
+
+	raw, msg, httpStatus, err := getMessage(docID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), httpStatus)
+		return
+	}
+
+	signer := dkimSignerFor(*msg)
+	if signer == nil {
+		http.Error(w, fmt.Sprintf("no DKIM key configured for sender of mail with ID %s", docID), 400)
+		return
+	}
+
+	var result DKIMResult
+	result.Domain = signer.Domain
+	result.Selector = signer.Selector
+	if result.Header, err = signer.Sign([]byte(raw)); err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), 500)
+		return
+	}
+
+	mustEncode(w, result)
+}
+
 func doSearch(hRequest SearchRequest, bRequest *bleve.SearchRequest, includeBody bool) (SearchResult, error) {
 	var hResult SearchResult
 	searchResult, err := index.Search(bRequest)
@@ -247,36 +484,63 @@ func doSearch(hRequest SearchRequest, bRequest *bleve.SearchRequest, includeBody
 			break
 		}
 
-		if v, ok := hit.Fields["Data"].(string); ok {
-			msg, err := mail.ReadMessage(strings.NewReader(v))
+		lr := Email{ID: hit.ID}
+		if includeBody {
+			raw, msg, _, err := getMessage(hit.ID)
 			if err != nil {
 				return hResult, err
 			}
-			lr := Email{ID: hit.ID, Header: msg.Header}
-
-			if includeBody {
-				lr.Body, err = getBody(msg)
-				if err != nil {
-					return hResult, err
-				}
+			lr.Header = msg.Header
+			lr.Body, err = getBody(msg)
+			if err != nil {
+				return hResult, err
+			}
+			if msg, err = mail.ReadMessage(strings.NewReader(raw)); err != nil {
+				return hResult, err
+			}
+			lr.Attachments = parseContent(msg).Attachments
+			lr.AttachmentCount = len(lr.Attachments)
+			if lr.Notes, err = loadNotes(hit.ID); err != nil {
+				return hResult, err
 			}
+		} else {
+			lr.Header = storedHeader(hit.Fields)
+		}
 
-			if deliveredS, ok := hit.Fields["Delivered"].(string); ok {
-				var d time.Time
-				if d, err = time.Parse(time.RFC3339, deliveredS); err != nil {
-					return hResult, err
-				}
-				lr.Delivered = &d
+		if deliveredS, ok := hit.Fields["Delivered"].(string); ok {
+			var d time.Time
+			if d, err = time.Parse(time.RFC3339, deliveredS); err != nil {
+				return hResult, err
 			}
+			lr.Delivered = &d
+		}
 
-			emails = append(emails, lr)
-		} else {
-			return hResult, fmt.Errorf("error retrieving document")
+		lr.Tags = fieldStrings(hit.Fields["Tags"])
+		lr.ThreadID = hitThreadID(hit.ID, hit.Fields)
+		lr.DuplicateOf = fieldString(hit.Fields["DuplicateOf"])
+		state := storedState(hit.Fields)
+		lr.Seen, lr.Starred, lr.Labels = state.Seen, state.Starred, state.Labels
+		if count, ok := hit.Fields["AttachmentCount"].(float64); ok {
+			lr.AttachmentCount = int(count)
+		}
+
+		if dkim, ok := hit.Fields["Auth.DKIM"].(string); ok {
+			lr.Auth = &authResults{
+				DKIM:        dkim,
+				DKIMDomains: fieldStrings(hit.Fields["Auth.DKIMDomains"]),
+				SPF:         fieldString(hit.Fields["Auth.SPF"]),
+				ARC:         fieldString(hit.Fields["Auth.ARC"]),
+			}
 		}
+
+		emails = append(emails, lr)
 	}
 
 	hResult.Total = searchResult.Total
 	hResult.Emails = emails
+	if len(searchResult.Facets) > 0 {
+		hResult.Domains = domainCounts(searchResult.Facets)
+	}
 	return hResult, nil
 }
 
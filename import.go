@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search/query"
+)
+
+const (
+	importMbox    = "mbox"
+	importMaildir = "maildir"
+	importMailHog = "mailhog"
+	importEML     = "eml"
+)
+
+const (
+	// messages requested per page of Mailpit's message list
+	mailpitPageSize = 100
+	mailpitTimeout  = 30 * time.Second
+)
+
+// layouts of the date in mbox 'From ' separator lines
+var mboxDateLayouts = []string{
+	mboxDateLayout,
+	"Mon Jan _2 15:04:05 -0700 2006",
+	"Mon Jan _2 15:04:05 MST 2006",
+}
+
+type ImportHandler struct{}
+
+type ImportResult struct {
+	Imported int
+	// messages already in the index
+	Skipped int
+	Failed  int
+	Errors  []string `json:",omitempty"`
+}
+
+// importedMessage is a message read from an archive. Fields other than Raw
+// are filled from the message headers when the archive doesn't record them.
+type importedMessage struct {
+	Raw        []byte
+	Received   time.Time
+	Sender     string
+	Recipients []string
+}
+
+// mailhogMessage is a message in the JSON returned by MailHog's API
+type mailhogMessage struct {
+	Created time.Time
+	Raw     struct {
+		From string
+		To   []string
+		Data string
+	}
+}
+
+// mailpitMessage is a message summary in Mailpit's message list
+type mailpitMessage struct {
+	ID      string
+	Created time.Time
+	To      []mailpitAddress
+	Cc      []mailpitAddress
+	Bcc     []mailpitAddress
+}
+
+type mailpitAddress struct {
+	Address string
+}
+
+// ImportHandler ingests an mbox, MailHog JSON or single message posted as the
+// request body. The format is detected unless given by the 'format' parameter.
+func (h *ImportHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	format := req.URL.Query().Get("format")
+	if format == importMaildir {
+		http.Error(w, "Maildir can only be imported with the import command", 400)
+		return
+	}
+
+	br := bufio.NewReader(req.Body)
+	if format == "" {
+		format = detectImportFormat(br)
+	}
+
+	var result ImportResult
+	if err := importReader(br, format, &result); err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), 400)
+		return
+	}
+
+	mustEncode(w, result)
+}
+
+// detectImportFormat guesses the format of an archive from its first bytes
+func detectImportFormat(br *bufio.Reader) string {
+	start, _ := br.Peek(512)
+	trimmed := bytes.TrimLeft(start, " \t\r\n")
+	switch {
+	case bytes.HasPrefix(start, []byte("From ")):
+		return importMbox
+	case len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '['):
+		return importMailHog
+	}
+	return importEML
+}
+
+// importReader imports every message in an archive of the given format
+func importReader(r io.Reader, format string, result *ImportResult) error {
+	add := func(m importedMessage) error {
+		result.add(importMessage(m))
+		return nil
+	}
+	switch format {
+	case importMbox:
+		return readMbox(r, add)
+	case importMailHog:
+		return readMailHog(r, add)
+	case importEML:
+		raw, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return add(importedMessage{Raw: raw})
+	}
+	return fmt.Errorf("unknown import format '%s'", format)
+}
+
+func (r *ImportResult) add(imported bool, err error) {
+	switch {
+	case err != nil:
+		r.Failed++
+		r.Errors = append(r.Errors, err.Error())
+	case imported:
+		r.Imported++
+	default:
+		r.Skipped++
+	}
+}
+
+// importMessage stores a message unless one with the same Message-ID, or
+// for messages without one the same fingerprint and received time, is
+// already in the index, reporting whether it was stored
+func importMessage(m importedMessage) (bool, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(m.Raw))
+	if err != nil {
+		return false, fmt.Errorf("error parsing message: %s", err)
+	}
+
+	doc := bleveDoc{Type: "message", Header: msg.Header, Recipients: m.Recipients, Sender: m.Sender}
+	doc.setContent(msg)
+	if len(doc.Recipients) == 0 {
+		doc.Recipients = headerAddresses(msg.Header, "Delivered-To", "To", "Cc")
+	}
+	if doc.Sender == "" {
+		if addresses := headerAddresses(msg.Header, "Return-Path", "From"); len(addresses) > 0 {
+			doc.Sender = addresses[0]
+		} else {
+			doc.Sender = nullSender
+		}
+	}
+	doc.Received = m.Received
+	if doc.Received.IsZero() {
+		doc.Received = headerReceived(msg.Header)
+	}
+
+	var exists bool
+	if doc.MessageID != "" {
+		exists, err = messageIDExists(doc.MessageID)
+	} else {
+		exists, err = fingerprintExists(fingerprint(doc), doc.Received)
+	}
+	if err != nil || exists {
+		return false, err
+	}
+	if msg.Header.Get("Date") == "" {
+		msg.Header["Date"] = []string{doc.Received.Format(RFC1123ZnoPadDay)}
+	}
+	doc.Size = len(m.Raw)
+
+	// IDs are the time of receipt
+	nanos := doc.Received.UnixNano()
+	for {
+		existing, err := index.Document(strconv.FormatInt(nanos, 10))
+		if err != nil {
+			return false, err
+		}
+		if existing == nil {
+			break
+		}
+		nanos++
+	}
+	id := strconv.FormatInt(nanos, 10)
+
+	if err = storeDoc(id, m.Raw, doc); err != nil {
+		return false, err
+	}
+	log.Printf("Imported mail ID %s, Message-ID: '%s', Subject: '%s'\n", id, doc.MessageID, msg.Header.Get("Subject"))
+	return true, nil
+}
+
+// messageIDExists reports whether a message with the given Message-ID is in
+// the index
+func messageIDExists(id string) (bool, error) {
+	idQuery := query.NewTermQuery(id)
+	idQuery.SetField("MessageID")
+	searchResult, err := index.Search(bleve.NewSearchRequestOptions(idQuery, 1, 0, false))
+	if err != nil {
+		return false, fmt.Errorf("error executing query: %v", err)
+	}
+	return searchResult.Total > 0, nil
+}
+
+// fingerprintExists reports whether a message with the given fingerprint
+// received at the given time is in the index, identifying imported messages
+// that have no Message-ID
+func fingerprintExists(fp string, received time.Time) (bool, error) {
+	fpQuery := query.NewTermQuery(fp)
+	fpQuery.SetField("Fingerprint")
+	inclusive := true
+	receivedQuery := query.NewDateRangeInclusiveQuery(received, received, &inclusive, &inclusive)
+	receivedQuery.SetField("Received")
+	searchResult, err := index.Search(bleve.NewSearchRequestOptions(query.NewConjunctionQuery([]query.Query{fpQuery, receivedQuery}), 1, 0, false))
+	if err != nil {
+		return false, fmt.Errorf("error executing query: %v", err)
+	}
+	return searchResult.Total > 0, nil
+}
+
+// headerAddresses returns the addresses in the first of the given header
+// fields that has any
+func headerAddresses(header mail.Header, fields ...string) []string {
+	for _, field := range fields {
+		list, err := header.AddressList(field)
+		if err != nil || len(list) == 0 {
+			continue
+		}
+		addresses := make([]string, 0, len(list))
+		for _, a := range list {
+			addresses = append(addresses, a.Address)
+		}
+		return addresses
+	}
+	return nil
+}
+
+// headerReceived returns the time a message was received according to its
+// most recent Received header, or failing that its Date
+func headerReceived(header mail.Header) time.Time {
+	if received := header["Received"]; len(received) > 0 {
+		if i := strings.LastIndex(received[0], ";"); i != -1 {
+			if t, err := mail.ParseDate(strings.TrimSpace(received[0][i+1:])); err == nil {
+				return t
+			}
+		}
+	}
+	if t, err := header.Date(); err == nil {
+		return t
+	}
+	return time.Now()
+}
+
+// readMbox calls fn for each message in an mbox, undoing mboxrd quoting
+func readMbox(r io.Reader, fn func(importedMessage) error) error {
+	br := bufio.NewReader(r)
+	var current *importedMessage
+	var buf bytes.Buffer
+	prevBlank := true
+
+	flush := func() error {
+		if current == nil {
+			return nil
+		}
+		// drop the blank line separating messages
+		current.Raw = bytes.TrimSuffix(append([]byte(nil), buf.Bytes()...), []byte("\n"))
+		buf.Reset()
+		return fn(*current)
+	}
+
+	for {
+		line, err := br.ReadString('\n')
+		if line == "" && err != nil {
+			if err != io.EOF {
+				return err
+			}
+			break
+		}
+		content := strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(content, "From ") && prevBlank {
+			if err := flush(); err != nil {
+				return err
+			}
+			current = mboxSeparator(content)
+		} else if current != nil {
+			if mboxFromRe.MatchString(content) && content[0] == '>' {
+				line = line[1:]
+			}
+			buf.WriteString(line)
+		}
+		prevBlank = content == ""
+	}
+	return flush()
+}
+
+// mboxSeparator reads the envelope sender and date of an mbox 'From ' line
+func mboxSeparator(line string) *importedMessage {
+	m := &importedMessage{}
+	fields := strings.Fields(strings.TrimPrefix(line, "From "))
+	if len(fields) == 0 {
+		return m
+	}
+	if fields[0] != "MAILER-DAEMON" {
+		m.Sender = fields[0]
+	}
+	date := strings.Join(fields[1:], " ")
+	for _, layout := range mboxDateLayouts {
+		if t, err := time.Parse(layout, date); err == nil {
+			m.Received = t
+			break
+		}
+	}
+	return m
+}
+
+// readMailHog calls fn for each message in MailHog API JSON, either a list
+// of messages or a search result with an 'items' list
+func readMailHog(r io.Reader, fn func(importedMessage) error) error {
+	var raw json.RawMessage
+	if err := json.NewDecoder(r).Decode(&raw); err != nil {
+		return fmt.Errorf("error parsing MailHog JSON: %s", err)
+	}
+	var messages []mailhogMessage
+	if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(raw, &messages); err != nil {
+			return fmt.Errorf("error parsing MailHog JSON: %s", err)
+		}
+	} else {
+		var result struct {
+			Items []mailhogMessage
+		}
+		if err := json.Unmarshal(raw, &result); err != nil {
+			return fmt.Errorf("error parsing MailHog JSON: %s", err)
+		}
+		messages = result.Items
+	}
+
+	for _, m := range messages {
+		err := fn(importedMessage{
+			Raw:        []byte(m.Raw.Data),
+			Received:   m.Created,
+			Sender:     m.Raw.From,
+			Recipients: m.Raw.To,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readMailpit calls fn for each message held by the Mailpit instance at the
+// given URL, paging through its message list and fetching each message's
+// source
+func readMailpit(baseURL string, fn func(importedMessage) error) error {
+	client := &http.Client{Timeout: mailpitTimeout}
+	baseURL = strings.TrimRight(baseURL, "/")
+	for start := 0; ; {
+		var page struct {
+			Total    int
+			Messages []mailpitMessage
+		}
+		body, err := mailpitGet(client, fmt.Sprintf("%s/api/v1/messages?start=%d&limit=%d", baseURL, start, mailpitPageSize))
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(body, &page); err != nil {
+			return fmt.Errorf("error parsing Mailpit JSON: %s", err)
+		}
+
+		for _, m := range page.Messages {
+			raw, err := mailpitGet(client, baseURL+"/api/v1/message/"+url.PathEscape(m.ID)+"/raw")
+			if err != nil {
+				return err
+			}
+			// Bcc recipients are only known from the summary
+			var recipients []string
+			for _, list := range [][]mailpitAddress{m.To, m.Cc, m.Bcc} {
+				for _, a := range list {
+					recipients = append(recipients, a.Address)
+				}
+			}
+			if err := fn(importedMessage{Raw: raw, Received: m.Created, Recipients: recipients}); err != nil {
+				return err
+			}
+		}
+
+		start += len(page.Messages)
+		if len(page.Messages) == 0 || start >= page.Total {
+			return nil
+		}
+	}
+}
+
+// mailpitGet returns the body of a successful GET request to Mailpit's API
+func mailpitGet(client *http.Client, u string) ([]byte, error) {
+	resp, err := client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Mailpit returned %s for %s", resp.Status, u)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// readMaildir calls fn for each message in the cur and new directories of a
+// Maildir tree
+func readMaildir(root string, fn func(importedMessage) error) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		if dir := filepath.Base(filepath.Dir(path)); dir != "cur" && dir != "new" {
+			return nil
+		}
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		m := importedMessage{Raw: raw, Received: info.ModTime()}
+		// file names start with the delivery time
+		name := info.Name()
+		if i := strings.Index(name, "."); i > 0 {
+			if secs, err := strconv.ParseInt(name[:i], 10, 64); err == nil {
+				m.Received = time.Unix(secs, 0)
+			}
+		}
+		return fn(m)
+	})
+}
+
+// importCommand imports the mbox files, Maildir trees, MailHog JSON, single
+// messages and Mailpit URLs given as arguments
+func importCommand(indexDir string) error {
+	if flag.NArg() == 0 {
+		return fmt.Errorf("usage: %s import -c config.toml path|url...", appName)
+	}
+
+	if err := openStorage(indexDir); err != nil {
+		return err
+	}
+	defer closeStorage()
+
+	var result ImportResult
+	add := func(m importedMessage) error {
+		result.add(importMessage(m))
+		return nil
+	}
+	for _, path := range flag.Args() {
+		if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
+			if err := readMailpit(path, add); err != nil {
+				return fmt.Errorf("error importing from '%s': %s", path, err)
+			}
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			err = readMaildir(path, add)
+		} else {
+			err = importFile(path, &result)
+		}
+		if err != nil {
+			return fmt.Errorf("error importing '%s': %s", path, err)
+		}
+	}
+
+	for _, e := range result.Errors {
+		fmt.Println(e)
+	}
+	fmt.Printf("Imported %d messages, skipped %d already imported, %d failed\n", result.Imported, result.Skipped, result.Failed)
+	return nil
+}
+
+func importFile(path string, result *ImportResult) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	return importReader(br, detectImportFormat(br), result)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const importMboxStr = `From sender@example.com Mon Jan  2 15:04:05 2006
+Message-ID: <mbox-1@example.com>
+From: sender@example.com
+To: mbox@example.com
+Subject: first
+
+>From the top
+>>From quoted
+
+From MAILER-DAEMON Tue Jan 10 09:00:00 2006
+Message-ID: <mbox-2@example.com>
+From: sender@example.com
+To: mbox@example.com
+Subject: second
+
+second body
+
+`
+
+func TestImportMbox(t *testing.T) {
+	// imported mail is old enough to trip other tests' retention policies
+	defer purge("mbox@example.com")
+
+	var messages []importedMessage
+	err := readMbox(strings.NewReader(importMboxStr), func(m importedMessage) error {
+		messages = append(messages, m)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(messages))
+	}
+	if !strings.HasSuffix(string(messages[0].Raw), "\nFrom the top\n>From quoted\n") {
+		t.Errorf("expected From lines to be unquoted, got '%s'", messages[0].Raw)
+	}
+	if messages[0].Sender != "sender@example.com" || messages[1].Sender != "" {
+		t.Errorf("unexpected senders '%s', '%s'", messages[0].Sender, messages[1].Sender)
+	}
+	if want := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC); !messages[0].Received.Equal(want) {
+		t.Errorf("expected received %s, got %s", want, messages[0].Received)
+	}
+
+	// posting twice only imports once
+	for i, want := range []ImportResult{{Imported: 2}, {Skipped: 2}} {
+		w := httptest.NewRecorder()
+		(&ImportHandler{}).ServeHTTP(w, httptest.NewRequest("POST", "/api/import", strings.NewReader(importMboxStr)))
+		var result ImportResult
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("unexpected error: %s (%s)", err, w.Body.String())
+		}
+		if result.Imported != want.Imported || result.Skipped != want.Skipped || result.Failed != 0 {
+			t.Errorf("import %d: expected %+v, got %+v", i, want, result)
+		}
+	}
+
+	ids, err := exportIDs(SearchRequest{Query: "mbox@example.com", Locations: []string{"To"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	found := false
+	for _, id := range ids {
+		doc, _, err := getDoc(id)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if doc.MessageID == "mbox-2@example.com" {
+			found = true
+			if doc.Sender != "sender@example.com" || doc.Recipients[0] != "mbox@example.com" {
+				t.Errorf("expected addresses from headers, got %+v", doc)
+			}
+			if doc.Received.Year() != 2006 {
+				t.Errorf("expected received date to be preserved, got %s", doc.Received)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("imported message not found")
+	}
+}
+
+func TestImportMailHogAndMaildir(t *testing.T) {
+	defer purge("rcpt@example.com")
+	defer purge("md@example.com")
+
+	created := time.Date(2017, 4, 4, 9, 0, 0, 0, time.UTC)
+	hog := `{"total": 1, "items": [{"Created": "2017-04-04T09:00:00Z", "Raw": {"From": "hog@example.com", "To": ["rcpt@example.com"], "Data": "Message-ID: <hog-1@example.com>\r\nSubject: hog\r\n\r\nbody"}}]}`
+	var result ImportResult
+	if err := importReader(strings.NewReader(hog), importMailHog, &result); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if result.Imported != 1 {
+		t.Fatalf("expected 1 message imported, got %+v", result)
+	}
+
+	dir, err := ioutil.TempDir("", appName)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, sub := range []string{"cur", "new", "tmp"} {
+		os.MkdirAll(filepath.Join(dir, "Sent", sub), 0700)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "Sent", "cur", "1491296400.M1P1.host:2,S"), []byte("Message-ID: <maildir-1@example.com>\nTo: md@example.com\n\nbody"), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "Sent", "tmp", "1491296401.M1P1.host"), []byte("Message-ID: <maildir-2@example.com>\n\npartial"), 0600)
+	// already imported from MailHog
+	ioutil.WriteFile(filepath.Join(dir, "Sent", "new", "1491296402.M1P1.host"), []byte("Message-ID: <hog-1@example.com>\n\nbody"), 0600)
+
+	var messages []importedMessage
+	err = readMaildir(dir, func(m importedMessage) error {
+		messages = append(messages, m)
+		result.add(importMessage(m))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(messages) != 2 {
+		t.Fatalf("expected messages in cur and new only, got %d", len(messages))
+	}
+	if result.Imported != 2 || result.Skipped != 1 {
+		t.Errorf("expected 2 imported and 1 skipped, got %+v", result)
+	}
+	if !messages[0].Received.Equal(created) {
+		t.Errorf("expected received from file name, got %s", messages[0].Received)
+	}
+}
+
+func TestImportMailpit(t *testing.T) {
+	defer purge("pit@example.com")
+
+	raws := map[string]string{
+		"a1": "Message-ID: <pit-1@example.com>\r\nTo: pit@example.com\r\nSubject: first\r\n\r\nbody",
+		// no Message-ID, so re-imports are spotted by fingerprint
+		"b2": "To: pit@example.com\r\nSubject: second\r\n\r\nbody",
+	}
+	summaries := []string{
+		`{"ID": "a1", "Created": "2020-02-03T04:05:06.789Z", "To": [{"Address": "pit@example.com"}]}`,
+		`{"ID": "b2", "Created": "2020-02-03T05:05:06.789Z", "To": [{"Address": "pit@example.com"}], "Bcc": [{"Address": "hidden@example.com"}]}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/v1/messages" {
+			// one message per page, whatever the limit
+			var start int
+			fmt.Sscan(r.URL.Query().Get("start"), &start)
+			fmt.Fprintf(w, `{"total": %d, "messages": [%s]}`, len(summaries), summaries[start])
+			return
+		}
+		id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/api/v1/message/"), "/raw")
+		raw, ok := raws[id]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, raw)
+	}))
+	defer server.Close()
+
+	for i, want := range []ImportResult{{Imported: 2}, {Skipped: 2}} {
+		var result ImportResult
+		err := readMailpit(server.URL+"/", func(m importedMessage) error {
+			result.add(importMessage(m))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if result.Imported != want.Imported || result.Skipped != want.Skipped || result.Failed != 0 {
+			t.Errorf("import %d: expected %+v, got %+v", i, want, result)
+		}
+	}
+
+	ids, err := exportIDs(SearchRequest{Query: "pit@example.com", Locations: []string{"To"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	found := 0
+	for _, id := range ids {
+		doc, _, err := getDoc(id)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if len(doc.Recipients) == 0 || doc.Recipients[0] != "pit@example.com" {
+			continue
+		}
+		found++
+		if doc.MessageID == "" && (len(doc.Recipients) != 2 || doc.Recipients[1] != "hidden@example.com") {
+			t.Errorf("expected Bcc recipient from the summary, got %v", doc.Recipients)
+		}
+		if doc.Received.Year() != 2020 {
+			t.Errorf("expected received date to be preserved, got %s", doc.Received)
+		}
+	}
+	if found != 2 {
+		t.Errorf("expected 2 messages, got %d", found)
+	}
+
+	if err := readMailpit(server.URL+"/missing", func(importedMessage) error { return nil }); err == nil {
+		t.Errorf("expected error for a URL that isn't Mailpit")
+	}
+}
@@ -2,12 +2,14 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net"
 	"net/mail"
 	"net/smtp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/blevesearch/bleve"
@@ -16,13 +18,14 @@ import (
 
 var mailSender EmailSender
 
+// EmailSender delivers a message, returning the reply of the remote end
 type EmailSender interface {
-	Send(to []string, from string, body []byte) error
+	Send(to []string, from string, body []byte) (string, error)
 }
 
 type emailSender struct {
 	conf MailConfig
-	send func(string, smtp.Auth, string, []string, []byte) error
+	send func(string, smtp.Auth, string, []string, []byte) (string, error)
 }
 
 type MailConfig struct {
@@ -42,7 +45,71 @@ func NewEmailSender(conf MailConfig) (EmailSender, error) {
 	if conf.Username != "" && conf.Password != "" {
 		conf.auth = smtp.PlainAuth("", conf.Username, conf.Password, host)
 	}
-	return &emailSender{conf, smtp.SendMail}, nil
+	return &emailSender{conf, smtpSendMail}, nil
+}
+
+// smtpSendMail works like smtp.SendMail, but returns the server's reply to
+// the end of the message data
+func smtpSendMail(addr string, a smtp.Auth, from string, to []string, msg []byte) (string, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	c, err := smtp.Dial(addr)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+
+	if err = c.Hello("localhost"); err != nil {
+		return "", err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err = c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return "", err
+		}
+	}
+	if a != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return "", fmt.Errorf("smtp: server doesn't support AUTH")
+		}
+		if err = c.Auth(a); err != nil {
+			return "", err
+		}
+	}
+	if err = c.Mail(from); err != nil {
+		return "", err
+	}
+	for _, rcpt := range to {
+		if err = c.Rcpt(rcpt); err != nil {
+			return "", err
+		}
+	}
+
+	id, err := c.Text.Cmd("DATA")
+	if err != nil {
+		return "", err
+	}
+	c.Text.StartResponse(id)
+	_, _, err = c.Text.ReadResponse(354)
+	c.Text.EndResponse(id)
+	if err != nil {
+		return "", err
+	}
+	w := c.Text.DotWriter()
+	if _, err = w.Write(msg); err != nil {
+		return "", err
+	}
+	if err = w.Close(); err != nil {
+		return "", err
+	}
+	code, reply, err := c.Text.ReadResponse(250)
+	if err != nil {
+		return "", err
+	}
+
+	c.Quit()
+	return fmt.Sprintf("%d %s", code, reply), nil
 }
 
 func HandleMessage(origin net.Addr, from string, to []string, data []byte) {
@@ -62,16 +129,28 @@ func handleMessage(origin net.Addr, from string, to []string, data []byte) error
 
 	subject := msg.Header.Get("Subject")
 
+	id := fmt.Sprintf("%v", time.Now().UnixNano())
+
 	var addresses []*mail.Address
 	var delivered time.Time
+	var history []releaseEvent
 	if addresses, err = msg.Header.AddressList("To"); err == nil {
-		if isWhitelisted(addresses) {
+		if entry := whitelistMatch(addresses); entry != "" {
 			log.Printf("Email whitelisted, To: '%s', From: '%s', Subject: '%s'\n", to[0], from, subject)
-			err = sendMail(data, *msg, to)
-			if err != nil {
+			event, sendErr := sendMail(data, *msg, from, to)
+			event.Actor = "whitelist:" + entry
+			if sendErr != nil {
+				releaseFailed(id, data, *msg, from, &event, sendErr)
+			}
+			if history, err = appendHistory(id, event); err != nil {
 				return err
 			}
-			delivered = time.Now()
+			if sendErr != nil {
+				// keep the message so it can be released later
+				log.Printf("Error sending whitelisted mail ID %s: %s\n", id, sendErr)
+			} else {
+				delivered = event.Time
+			}
 		}
 	}
 
@@ -83,10 +162,29 @@ func handleMessage(origin net.Addr, from string, to []string, data []byte) error
 	}
 
 	fmt.Printf("handle message to %+v\n", to)
-	doc := bleveDoc{Type: "message", Header: msg.Header, Data: string(data), Delivered: delivered, Recipients: to}
+	doc := bleveDoc{Type: "message", Header: msg.Header, Delivered: delivered, Recipients: to, History: history}
+	doc.setContent(msg)
+
+	doc.Received = time.Now()
+	doc.Size = len(data)
+	doc.Sender = from
+	if from == "" {
+		doc.Sender = nullSender
+	}
 
-	id := fmt.Sprintf("%v", time.Now().UnixNano())
-	if err := index.Index(id, doc); err != nil {
+	clientIP := originIP(origin)
+	if clientIP != nil {
+		doc.ClientIP = clientIP.String()
+	}
+	if config.VerifyAuth {
+		doc.Auth = verifyAuth(data, clientIP, from, resolver)
+		log.Printf("Authentication results, DKIM: %s, SPF: %s, ARC: %s\n", doc.Auth.DKIM, doc.Auth.SPF, doc.Auth.ARC)
+	}
+
+	if err := storeDoc(id, data, doc); err != nil {
+		if len(history) > 0 {
+			dropHistory(id)
+		}
 		return err
 	}
 
@@ -94,6 +192,36 @@ func handleMessage(origin net.Addr, from string, to []string, data []byte) error
 	return nil
 }
 
+// ingestMu serialises the index lookups made when storing a message, so
+// related messages arriving together see each other
+var ingestMu sync.Mutex
+
+// storeDoc saves a new message to the message store and the index, assigning
+// its thread and flagging it if it duplicates an earlier message
+func storeDoc(id string, data []byte, doc bleveDoc) error {
+	if err := msgStore.Put(id, data); err != nil {
+		return err
+	}
+	doc.Fingerprint = fingerprint(doc)
+	ingestMu.Lock()
+	err := assignThread(id, &doc)
+	if err == nil {
+		err = flagDuplicate(&doc)
+	}
+	if err == nil {
+		err = index.Index(id, doc)
+	}
+	ingestMu.Unlock()
+	if err != nil {
+		msgStore.Delete(id)
+		return err
+	}
+	if err := evictMessages(); err != nil {
+		log.Println(err)
+	}
+	return nil
+}
+
 /*
 // itob returns an 8-byte big endian representation of v.
 func itob(v uint64) []byte {
@@ -103,106 +231,518 @@ func itob(v uint64) []byte {
 }
 */
 
-func sendMailDoc(docID string) (int, error) {
+// getMessage returns the raw data and parsed message of the given doc ID
+func getMessage(docID string) (string, *mail.Message, int, error) {
+	data, err := msgStore.Get(docID)
+	if err == errNotStored {
+		return "", nil, 404, fmt.Errorf("mail with ID %s not found", docID)
+	}
+	if err != nil {
+		return "", nil, 500, fmt.Errorf("error retrieving document: %v", err)
+	}
+
+	raw := string(data)
+	msg, err := mail.ReadMessage(strings.NewReader(raw))
+	if err != nil {
+		return "", nil, 500, err
+	}
+
+	return raw, msg, 200, nil
+}
+
+// getDoc loads the stored document with the given ID
+func getDoc(docID string) (bleveDoc, int, error) {
+	var doc bleveDoc
 	docQuery := query.NewDocIDQuery([]string{docID})
 
 	bRequest := bleve.NewSearchRequest(docQuery)
-	bRequest.Fields = []string{"Data", "Delivered", "Recipients"}
+	bRequest.Fields = []string{"*"}
 
 	searchResult, err := index.Search(bRequest)
 	if err != nil {
-		return 500, fmt.Errorf("error executing query: %v", err)
+		return doc, 500, fmt.Errorf("error executing query: %v", err)
 	}
-
-	var msg *mail.Message
 	if len(searchResult.Hits) != 1 {
-		return 404, fmt.Errorf("mail with ID %s not found", docID)
+		return doc, 404, fmt.Errorf("mail with ID %s not found", docID)
 	}
+	fields := searchResult.Hits[0].Fields
 
-	var raw string
-	var ok bool
-	hit := searchResult.Hits[0]
-	if _, ok = hit.Fields["Delivered"].(string); ok {
-		return 400, fmt.Errorf("mail with ID %s already delivered", docID)
+	_, msg, httpStatus, err := getMessage(docID)
+	if err != nil {
+		return doc, httpStatus, err
 	}
 
-	if raw, ok = hit.Fields["Data"].(string); ok {
-		msg, err = mail.ReadMessage(strings.NewReader(raw))
-		if err != nil {
-			return 500, err
+	// keep a date added at ingest time
+	if date, ok := fields["Header.Date"].(string); ok && msg.Header.Get("Date") == "" {
+		if d, err := time.Parse(time.RFC3339, date); err == nil {
+			msg.Header["Date"] = []string{d.Format(RFC1123ZnoPadDay)}
+		}
+	}
+
+	doc = bleveDoc{
+		Type:       "message",
+		Header:     msg.Header,
+		Recipients: fieldStrings(fields["Recipients"]),
+		Sender:     fieldString(fields["Sender"]),
+		ClientIP:   fieldString(fields["ClientIP"]),
+		Auth: authResults{
+			DKIM:        fieldString(fields["Auth.DKIM"]),
+			DKIMDomains: fieldStrings(fields["Auth.DKIMDomains"]),
+			SPF:         fieldString(fields["Auth.SPF"]),
+			ARC:         fieldString(fields["Auth.ARC"]),
+		},
+		Tags:        fieldStrings(fields["Tags"]),
+		BounceOf:    fieldString(fields["BounceOf"]),
+		ThreadID:    hitThreadID(docID, fields),
+		DuplicateOf: fieldString(fields["DuplicateOf"]),
+	}
+	doc.setContent(msg)
+	doc.Fingerprint = fingerprint(doc)
+	if doc.History, err = loadHistory(docID); err != nil {
+		return doc, 500, err
+	}
+	if doc.Notes, err = loadNotes(docID); err != nil {
+		return doc, 500, err
+	}
+	if doc.State, err = loadState(docID, fields); err != nil {
+		return doc, 500, err
+	}
+	if delivered, ok := fields["Delivered"].(string); ok {
+		if doc.Delivered, err = time.Parse(time.RFC3339, delivered); err != nil {
+			return doc, 500, err
+		}
+	}
+	if received, ok := fields["Received"].(string); ok {
+		if doc.Received, err = time.Parse(time.RFC3339, received); err != nil {
+			return doc, 500, err
+		}
+	}
+	if size, ok := fields["Size"].(float64); ok {
+		doc.Size = int(size)
+	}
+
+	return doc, 200, nil
+}
+
+// fieldString returns a stored string field, or empty if not present.
+// The first value of a multi-valued field is returned.
+func fieldString(v interface{}) string {
+	if values := fieldStrings(v); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// storedHeader rebuilds a message header from the stored Header fields of a
+// search hit, saving a trip to the message store
+func storedHeader(fields map[string]interface{}) mail.Header {
+	header := make(mail.Header)
+	for name, v := range fields {
+		if !strings.HasPrefix(name, locationsBase) {
+			continue
+		}
+		key := strings.TrimPrefix(name, locationsBase)
+		values := fieldStrings(v)
+		if key == "Date" {
+			// dates are stored parsed
+			for i, date := range values {
+				if d, err := time.Parse(time.RFC3339, date); err == nil {
+					values[i] = d.Format(RFC1123ZnoPadDay)
+				}
+			}
 		}
-	} else {
-		return 500, fmt.Errorf("error retrieving document")
+		header[key] = values
 	}
+	return header
+}
 
-	var recipients []string
-	if rcpts, ok := hit.Fields["Recipients"].([]interface{}); ok {
-		recipients = make([]string, 0)
-		for _, r := range rcpts {
-			if rcpt, ok := r.(string); ok {
-				recipients = append(recipients, rcpt)
+// fieldStrings returns a stored string slice field
+func fieldStrings(v interface{}) []string {
+	values := make([]string, 0)
+	switch v := v.(type) {
+	case []interface{}:
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				values = append(values, s)
 			}
 		}
-	} else {
+	case string:
 		// Bleve doesn't handle arrays properly.
 		// A string slice with a single element will be returned as a string.
 		// See: https://github.com/blevesearch/bleve/issues/570
-		if rcpt, ok := hit.Fields["Recipients"].(string); ok {
-			recipients = []string{rcpt}
-		} else {
-			return 400, fmt.Errorf("mail with ID %s has no recipients", docID)
+		values = append(values, v)
+	}
+	return values
+}
+
+// docLock serialises the read, change and re-index of one document by
+// updates, releases and deletes
+type docLock struct {
+	sync.Mutex
+	// holders and waiters, so unused locks are dropped
+	refs int
+}
+
+var (
+	docLocksMu sync.Mutex
+	docLocks   = make(map[string]*docLock)
+)
+
+// lockDoc locks a document against other updates, releases and deletes until
+// the returned function is called
+func lockDoc(docID string) func() {
+	docLocksMu.Lock()
+	l, ok := docLocks[docID]
+	if !ok {
+		l = &docLock{}
+		docLocks[docID] = l
+	}
+	l.refs++
+	docLocksMu.Unlock()
+
+	l.Lock()
+	return func() { unlockDoc(docID, l) }
+}
+
+// tryLockDoc is lockDoc for callers which can't wait, failing if the
+// document is locked
+func tryLockDoc(docID string) (func(), bool) {
+	docLocksMu.Lock()
+	defer docLocksMu.Unlock()
+	if _, ok := docLocks[docID]; ok {
+		return nil, false
+	}
+	l := &docLock{refs: 1}
+	l.Lock()
+	docLocks[docID] = l
+	return func() { unlockDoc(docID, l) }, true
+}
+
+func unlockDoc(docID string, l *docLock) {
+	l.Unlock()
+	docLocksMu.Lock()
+	if l.refs--; l.refs == 0 {
+		delete(docLocks, docID)
+	}
+	docLocksMu.Unlock()
+}
+
+// updateDoc loads a document, applies update to it and re-indexes it, with
+// the document locked throughout
+func updateDoc(docID string, update func(*bleveDoc) error) (int, error) {
+	unlock := lockDoc(docID)
+	defer unlock()
+
+	doc, httpStatus, err := getDoc(docID)
+	if err != nil {
+		return httpStatus, err
+	}
+	if err = update(&doc); err != nil {
+		return 400, err
+	}
+	if err = index.Index(docID, doc); err != nil {
+		return 500, err
+	}
+	return 200, nil
+}
+
+// deleteDoc removes a message from the index
+func deleteDoc(docID string) (int, error) {
+	unlock := lockDoc(docID)
+	defer unlock()
+	return deleteLockedDoc(docID)
+}
+
+// deleteLockedDoc is deleteDoc for a document the caller has locked
+func deleteLockedDoc(docID string) (int, error) {
+	doc, err := index.Document(docID)
+	if err != nil {
+		return 500, err
+	}
+	if doc == nil {
+		return 404, fmt.Errorf("mail with ID %s not found", docID)
+	}
+	if err = index.Delete(docID); err != nil {
+		return 500, err
+	}
+	if err = deleteHistory(docID); err != nil {
+		return 500, err
+	}
+	if err = deleteNotes(docID); err != nil {
+		return 500, err
+	}
+	if err = deleteState(docID); err != nil {
+		return 500, err
+	}
+	if err = msgStore.Delete(docID); err != nil {
+		return 500, err
+	}
+	log.Printf("Deleted mail ID %s\n", docID)
+	return 200, nil
+}
+
+// tagDoc adds a tag to a message, if it doesn't already have it
+func tagDoc(docID, tag string) (int, error) {
+	return updateDoc(docID, func(doc *bleveDoc) error {
+		for _, t := range doc.Tags {
+			if t == tag {
+				return nil
+			}
 		}
+		doc.Tags = append(doc.Tags, tag)
+		return nil
+	})
+}
+
+// sendMailDoc releases a stored message, recording the attempt in its history.
+// The document stays locked until the attempt is indexed, so it can't be
+// released twice or have changes made meanwhile overwritten.
+func sendMailDoc(docID string, actor releaseActor) (int, error) {
+	unlock := lockDoc(docID)
+	defer unlock()
+
+	doc, httpStatus, err := getDoc(docID)
+	if err != nil {
+		return httpStatus, err
+	}
+
+	if !doc.Delivered.IsZero() {
+		return 400, fmt.Errorf("mail with ID %s already delivered", docID)
+	}
+	if len(doc.Recipients) == 0 {
+		return 400, fmt.Errorf("mail with ID %s has no recipients", docID)
+	}
+	// a retry only goes to the recipients earlier attempts didn't reach
+	rcpts := pendingRecipients(doc)
+	if len(rcpts) == 0 {
+		return 400, fmt.Errorf("mail with ID %s already delivered", docID)
+	}
+
+	data, err := msgStore.Get(docID)
+	if err != nil {
+		return 500, fmt.Errorf("error retrieving mail with ID %s: %v", docID, err)
 	}
 
-	if err = sendMail([]byte(raw), *msg, recipients); err != nil {
-		return 500, fmt.Errorf("error sending mail with ID %s: %v", docID, err)
+	msg := mail.Message{Header: doc.Header}
+	sender := envelopeSender(doc)
+	event, sendErr := sendMail(data, msg, sender, rcpts)
+	event.Actor = actor.Name
+	event.RemoteAddr = actor.RemoteAddr
+	if sendErr != nil {
+		releaseFailed(docID, data, msg, sender, &event, sendErr)
+	}
+	if doc.History, err = appendHistory(docID, event); err != nil {
+		return 500, err
+	}
+	// the event is dropped again if the index can't be updated to match
+	if sendErr != nil {
+		// re-index so the failed attempt is searchable
+		if err = index.Index(docID, doc); err != nil {
+			dropHistory(docID)
+			return 500, err
+		}
+		return 500, fmt.Errorf("error sending mail with ID %s: %v", docID, sendErr)
 	}
 
-	delivered := time.Now()
+	doc.Delivered = event.Time
 
 	if err = index.Delete(docID); err != nil {
+		dropHistory(docID)
 		return 500, err
 	}
-	doc := bleveDoc{Type: "message", Header: msg.Header, Data: raw, Delivered: delivered, Recipients: recipients}
 	if err := index.Index(docID, doc); err != nil {
+		dropHistory(docID)
 		return 500, err
 	}
 
 	return 200, nil
 }
 
-func sendMail(data []byte, msg mail.Message, rcpts []string) error {
+// sendMail hands a message to its transport, using sender as the envelope
+// sender subject to any return-path rewrite. The returned event describes the
+// attempt, whether or not it succeeded.
+func sendMail(data []byte, msg mail.Message, sender string, rcpts []string) (releaseEvent, error) {
 	var err error
-	from := msg.Header.Get("From")
+	event := releaseEvent{Time: time.Now(), Recipients: rcpts, ReturnPath: returnPath(sender, "")}
+
+	if signer := dkimSignerFor(msg); signer != nil {
+		var sig string
+		if sig, err = signer.Sign(data); err != nil {
+			event.Response = err.Error()
+			event.Failed = rcpts
+			return event, fmt.Errorf("error DKIM signing mail: %s", err)
+		}
+		data = append([]byte(sig), data...)
+	}
+
+	transport, out, err := selectTransport(sender, rcpts)
+	event.Transport = transport
+	if err != nil {
+		event.Response = err.Error()
+		event.Failed = rcpts
+		return event, err
+	}
+
+	// with VERP each recipient gets its own envelope sender, so a copy is
+	// sent per recipient
+	batches := [][]string{rcpts}
+	if config.ReturnPathVERP && sender != "" {
+		batches = make([][]string, 0, len(rcpts))
+		for _, rcpt := range rcpts {
+			batches = append(batches, []string{rcpt})
+		}
+	}
+
+	responses := make([]string, 0, len(batches))
+	failures := make(deliveryError, 0)
+	for _, batch := range batches {
+		from := returnPath(sender, batch[0])
+		outboundLimiter.Wait(transport, from, batch)
+
+		event.Time = time.Now()
+		response, err := out.Send(batch, from, data)
+		if err != nil {
+			// carry on, so one failed VERP copy doesn't stop the rest
+			for _, rcpt := range batch {
+				failures = append(failures, recipientFailure{rcpt, err})
+			}
+			responses = append(responses, err.Error())
+			continue
+		}
+		responses = append(responses, response)
 
-	if err = mailSender.Send(rcpts, from, data); err != nil {
-		return err
-	} else {
 		subject := msg.Header.Get("Subject")
-		log.Printf("Sending mail, Recipients: %s, From: '%s', Subject: '%s'\n", rcpts, from, subject)
+		log.Printf("Sending mail via %s, Recipients: %s, From: '%s', Subject: '%s'\n", transport, batch, from, subject)
 	}
 
-	return nil
+	event.Response = strings.Join(responses, "; ")
+	if len(failures) > 0 {
+		event.Failed = failures.recipients()
+		return event, failures
+	}
+	event.Success = true
+	return event, nil
+}
+
+// deliveryError is returned by sendMail when any recipient wasn't reached,
+// with the error for each
+type deliveryError []recipientFailure
+
+type recipientFailure struct {
+	Recipient string
+	Err       error
+}
+
+func (e deliveryError) Error() string {
+	msgs := make([]string, 0, len(e))
+	shared := true
+	for _, f := range e {
+		msgs = append(msgs, f.Recipient+": "+f.Err.Error())
+		shared = shared && f.Err.Error() == e[0].Err.Error()
+	}
+	// recipients sent in one batch share its error
+	if shared {
+		return e[0].Err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (e deliveryError) recipients() []string {
+	rcpts := make([]string, 0, len(e))
+	for _, f := range e {
+		rcpts = append(rcpts, f.Recipient)
+	}
+	return rcpts
+}
+
+// recipientFailures returns the error for each recipient that sendMail failed
+// to reach
+func recipientFailures(event releaseEvent, err error) deliveryError {
+	if failures, ok := err.(deliveryError); ok {
+		return failures
+	}
+	failures := make(deliveryError, 0, len(event.Failed))
+	for _, rcpt := range event.Failed {
+		failures = append(failures, recipientFailure{rcpt, err})
+	}
+	return failures
+}
+
+// pendingRecipients returns the recipients of a document that no earlier
+// release attempt reached
+func pendingRecipients(doc bleveDoc) []string {
+	reached := make(map[string]bool)
+	for _, event := range doc.History {
+		// failures recorded before per-recipient results reached no one
+		if !event.Success && len(event.Failed) == 0 {
+			continue
+		}
+		for _, rcpt := range event.Recipients {
+			if !containsString(event.Failed, rcpt) {
+				reached[rcpt] = true
+			}
+		}
+	}
+	rcpts := make([]string, 0, len(doc.Recipients))
+	for _, rcpt := range doc.Recipients {
+		if !reached[rcpt] {
+			rcpts = append(rcpts, rcpt)
+		}
+	}
+	return rcpts
+}
+
+// returnPath applies the configured return-path rewrite to an envelope
+// sender. With VERP the recipient is encoded into the address, e.g.
+// bounces+bob=example.com@example.org. The null sender is never rewritten.
+func returnPath(sender, rcpt string) string {
+	if sender == "" || config.ReturnPath == "" {
+		return sender
+	}
+	if !config.ReturnPathVERP {
+		return config.ReturnPath
+	}
+	i := strings.LastIndex(config.ReturnPath, "@")
+	if rcpt == "" || i < 0 {
+		return config.ReturnPath
+	}
+	return config.ReturnPath[:i] + "+" + strings.Replace(rcpt, "@", "=", -1) + config.ReturnPath[i:]
+}
+
+// envelopeSender returns the SMTP envelope sender of a document. Documents
+// stored before the envelope was recorded fall back to the From address.
+func envelopeSender(doc bleveDoc) string {
+	switch doc.Sender {
+	case nullSender:
+		return ""
+	case "":
+		if a, err := mail.ParseAddress(doc.Header.Get("From")); err == nil {
+			return a.Address
+		}
+	}
+	return doc.Sender
 }
 
-func isWhitelisted(emails []*mail.Address) bool {
+// whitelistMatch returns the whitelist entry matching any of the addresses,
+// or empty if none do
+func whitelistMatch(emails []*mail.Address) string {
 	for _, e := range emails {
 		for _, w := range config.Whitelist {
 			if strings.Contains(w, "@") {
 				if w == e.Address {
-					return true
+					return w
 				}
 			} else {
 				parts := strings.Split(e.Address, "@")
 				if len(parts) == 2 && w == parts[1] {
-					return true
+					return w
 				}
 			}
 		}
 	}
-	return false
+	return ""
 }
 
-func (e *emailSender) Send(to []string, from string, body []byte) error {
+func (e *emailSender) Send(to []string, from string, body []byte) (string, error) {
 	return e.send(e.conf.ServerAddr, e.conf.auth, from, to, body)
 }
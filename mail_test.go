@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/mail"
@@ -51,6 +52,47 @@ func TestHandle(t *testing.T) {
 	}
 }
 
+func TestHandleWhitelistError(t *testing.T) {
+	f, _ := mockSend(fmt.Errorf("451 try again later"))
+	mailSender = &emailSender{send: f}
+	config.Whitelist = []string{"example.com"}
+	defer func() {
+		f, _ := mockSend(nil)
+		mailSender = &emailSender{send: f}
+		config.Whitelist = nil
+	}()
+
+	defer purge("whitelist-error@example.com")
+
+	// the message is held with the failed attempt, so it can be released later
+	if err := handleMessage(nil, "from@example.com", []string{"whitelist-error@example.com"}, []byte(emailStr)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	docs, err := retainedDocs()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var id string
+	for _, doc := range docs {
+		if len(doc.Recipients) == 1 && doc.Recipients[0] == "whitelist-error@example.com" {
+			id = doc.ID
+		}
+	}
+	if id == "" {
+		t.Fatalf("expected the message to be stored")
+	}
+	doc, _, err := getDoc(id)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !doc.Delivered.IsZero() {
+		t.Errorf("expected the message not to be delivered")
+	}
+	if len(doc.History) != 1 || doc.History[0].Success || doc.History[0].Actor != "whitelist:example.com" {
+		t.Errorf("expected a failed release event, got %+v", doc.History)
+	}
+}
+
 func TestSendMail(t *testing.T) {
 	msg, err := mail.ReadMessage(bytes.NewReader([]byte(emailStr)))
 	if err != nil {
@@ -58,16 +100,64 @@ func TestSendMail(t *testing.T) {
 	}
 
 	rcpts := []string{"to@example.com"}
-	doc := bleveDoc{Type: "message", Header: msg.Header, Data: emailStr, Recipients: rcpts}
+	doc := bleveDoc{Type: "message", Header: msg.Header, Recipients: rcpts}
 
 	id := fmt.Sprintf("%v", time.Now().UnixNano())
+	if err := msgStore.Put(id, []byte(emailStr)); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
 	if err := index.Index(id, doc); err != nil {
 		t.Errorf("unexpected error: %s", err)
 	}
-	_, err = sendMailDoc(id)
+	_, err = sendMailDoc(id, releaseActor{Name: "test"})
 	if err != nil {
 		t.Errorf("unexpected error: %s", err)
 	}
+
+	history, err := loadHistory(id)
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if len(history) != 1 || !history[0].Success || history[0].Actor != "test" {
+		t.Errorf("unexpected release history %+v", history)
+	}
+}
+
+func TestEnvelopeSender(t *testing.T) {
+	f, r := mockSend(nil)
+	mailSender = &emailSender{send: f}
+	defer func() {
+		f, _ := mockSend(nil)
+		mailSender = &emailSender{send: f}
+		config.ReturnPath = ""
+		config.ReturnPathVERP = false
+	}()
+
+	tests := []struct {
+		returnPath string
+		verp       bool
+		expected   string
+	}{
+		{"", false, "bounce@example.com"},
+		{"bounces@example.org", false, "bounces@example.org"},
+		{"bounces@example.org", true, "bounces+to=example.com@example.org"},
+	}
+	for i, test := range tests {
+		config.ReturnPath = test.returnPath
+		config.ReturnPathVERP = test.verp
+
+		msg, err := mail.ReadMessage(bytes.NewReader([]byte(emailStr)))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		_, err = sendMail([]byte(emailStr), *msg, "bounce@example.com", []string{"to@example.com"})
+		if err != nil {
+			t.Errorf("test %d: unexpected error: %s", i, err)
+		}
+		if r.from != test.expected {
+			t.Errorf("test %d: expected envelope sender '%s', got '%s'", i, test.expected, r.from)
+		}
+	}
 }
 
 func setupTest() error {
@@ -77,15 +167,22 @@ func setupTest() error {
 	if err != nil {
 		return err
 	}
+	dir, err := ioutil.TempDir("", appName)
+	if err != nil {
+		return err
+	}
+	if msgStore, err = openStore(boltStorage, dir); err != nil {
+		return err
+	}
 	f, _ := mockSend(nil)
 	mailSender = &emailSender{send: f}
 	return nil
 }
 
-func mockSend(errToReturn error) (func(string, smtp.Auth, string, []string, []byte) error, *emailRecorder) {
+func mockSend(errToReturn error) (func(string, smtp.Auth, string, []string, []byte) (string, error), *emailRecorder) {
 	r := new(emailRecorder)
-	return func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+	return func(addr string, a smtp.Auth, from string, to []string, msg []byte) (string, error) {
 		*r = emailRecorder{addr, a, from, to, msg}
-		return errToReturn
+		return "250 OK", errToReturn
 	}, r
 }
@@ -5,14 +5,31 @@ import (
 	"log"
 	"net/smtp"
 	"os"
+	"strings"
 
 	"github.com/blevesearch/bleve"
 	"github.com/mhale/smtpd"
 )
 
+// commands run in place of the mail and web servers, e.g.
+// 'icemail reindex -c config.toml'. They are passed the index directory.
+var commands = map[string]func(string) error{
+	"reindex": reindexCommand,
+	"export":  exportCommand,
+	"import":  importCommand,
+	"backup":  backupCommand,
+	"restore": restoreCommand,
+}
+
 func main() {
 	var err error
 
+	var command string
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		command = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
 	if err = loadConfig(); err != nil {
 		log.Fatal(err)
 	}
@@ -24,23 +41,32 @@ func main() {
 		indexDir = appName + ".db"
 	}
 
-	// try opening index, otherwise try creating new
-	index, err = bleve.Open(indexDir)
-	if err != nil {
-		// if the index exists but couldn't be opened, don't proceed
-		if _, err2 := os.Stat(indexDir); err2 == nil {
-			log.Fatalf("Error opening index '%s': %s\n", indexDir, err)
+	if command != "" {
+		run, ok := commands[command]
+		if !ok {
+			log.Fatalf("Unknown command '%s'\n", command)
 		}
+		// backup can fetch from a running icemail, which is the only place
+		// memory storage exists
+		if config.Storage == memoryStorage && command != "backup" {
+			log.Fatalf("The %s command can't be used with memory storage\n", command)
+		}
+		if err = run(indexDir); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-		fmt.Printf("Creating database '%s'\n", indexDir)
+	if err = openStorage(indexDir); err != nil {
+		log.Fatal(err)
+	}
 
-		mapping := buildIndexMapping()
-		index, err = bleve.New(indexDir, mapping)
-		if err != nil {
-			log.Fatalf("Error creating index '%s': %s\n", indexDir, err)
-		}
-	} else {
-		fmt.Printf("Loading database '%s'\n", indexDir)
+	stale, err := checkSchema()
+	if err != nil {
+		log.Fatalf("Error opening index '%s': %s\n", indexDir, err)
+	}
+	if stale {
+		log.Printf("Index '%s' was built with an older schema. Stop %s and run '%s reindex' to rebuild it\n", indexDir, appName, appName)
 	}
 
 	// sanity check
@@ -57,6 +83,25 @@ func main() {
 		log.Fatalf("Error configuring email settings: %s\n", err)
 	}
 
+	if dkimSigners, err = loadDKIMSigners(config.DKIM); err != nil {
+		log.Fatalf("Error configuring DKIM: %s\n", err)
+	}
+
+	if resolver, err = newResolver(config.DNSServer, config.DNSZoneFile); err != nil {
+		log.Fatalf("Error configuring DNS resolver: %s\n", err)
+	}
+
+	outboundLimiter = newDeliveryLimiter(config.RateLimit)
+
+	if transports, err = loadTransports(config.Transports); err != nil {
+		log.Fatalf("Error configuring transports: %s\n", err)
+	}
+	defaultTransport = config.Transport
+	transportRules = config.TransportRules
+	if err = checkTransports(); err != nil {
+		log.Fatalf("Error configuring transports: %s\n", err)
+	}
+
 	//Test SMTP server connection
 	var c *smtp.Client
 	if c, err = smtp.Dial(config.SMTPServerAddr); err != nil {
@@ -64,6 +109,11 @@ func main() {
 	}
 	c.Close()
 
+	if config.Retention.enabled() {
+		fmt.Printf("Retention janitor running every %s\n", config.Retention.interval())
+		go retentionJanitor(config.Retention)
+	}
+
 	//go outputStats()
 	go httpServer()
 
@@ -71,6 +121,68 @@ func main() {
 	smtpd.ListenAndServe(config.SMTPBindAddr, HandleMessage, appName, "")
 }
 
+// openStorage opens the message store and the index, creating the index if
+// it doesn't exist
+func openStorage(indexDir string) error {
+	var err error
+	if config.Storage == memoryStorage {
+		msgStore = newMemStore(config.MemoryMaxSize)
+		if index, err = bleve.NewMemOnly(buildIndexMapping()); err != nil {
+			return fmt.Errorf("Error creating index: %s", err)
+		}
+		if err = setIndexSchema(index, schemaVersion); err != nil {
+			return fmt.Errorf("Error creating index: %s", err)
+		}
+		log.Printf("WARNING: using memory storage. Nothing is written to disk and all mail will be lost when %s exits\n", appName)
+		if config.MemoryMaxSize > 0 {
+			log.Printf("Keeping at most %d bytes of mail, evicting the oldest first\n", config.MemoryMaxSize)
+		}
+		return nil
+	}
+
+	// the message store is opened first, as it can't be shared with a
+	// running reindex
+	if msgStore, err = openStore(config.Storage, storeDir()); err != nil {
+		return fmt.Errorf("Error opening message store: %s", err)
+	}
+
+	// try opening index, otherwise try creating new
+	index, err = bleve.Open(indexDir)
+	if err != nil {
+		// if the index exists but couldn't be opened, don't proceed
+		if _, err2 := os.Stat(indexDir); err2 == nil {
+			return fmt.Errorf("Error opening index '%s': %s", indexDir, err)
+		}
+
+		fmt.Printf("Creating database '%s'\n", indexDir)
+
+		mapping := buildIndexMapping()
+		index, err = bleve.New(indexDir, mapping)
+		if err != nil {
+			return fmt.Errorf("Error creating index '%s': %s", indexDir, err)
+		}
+		if err = setIndexSchema(index, schemaVersion); err != nil {
+			return fmt.Errorf("Error creating index '%s': %s", indexDir, err)
+		}
+	} else {
+		fmt.Printf("Loading database '%s'\n", indexDir)
+	}
+
+	if _, err = migrateData(); err != nil {
+		return fmt.Errorf("Error moving messages out of index '%s': %s", indexDir, err)
+	}
+	return nil
+}
+
+func closeStorage() {
+	if err := index.Close(); err != nil {
+		log.Printf("Error closing index: %s\n", err)
+	}
+	if err := msgStore.Close(); err != nil {
+		log.Printf("Error closing message store: %s\n", err)
+	}
+}
+
 /*
 func outputStats() {
 	for {
@@ -6,6 +6,7 @@ import (
 
 	"github.com/blevesearch/bleve"
 	"github.com/blevesearch/bleve/analysis"
+	"github.com/blevesearch/bleve/analysis/analyzer/keyword"
 	"github.com/blevesearch/bleve/analysis/datetime/flexible"
 	"github.com/blevesearch/bleve/mapping"
 	"github.com/blevesearch/bleve/registry"
@@ -14,14 +15,54 @@ import (
 type bleveDoc struct {
 	Type   string
 	Header mail.Header
-	// store raw email data
-	Data       string
-	Delivered  time.Time
+	// Message-ID header without angle brackets, for exact matching
+	MessageID string
+	Addresses messageAddresses
+	// Message-IDs from In-Reply-To and References, and the subject without
+	// reply prefixes, used to assign ThreadID
+	References    []string
+	ThreadSubject string
+	// ID of the conversation the message belongs to
+	ThreadID string
+	// hash of the content, and the ID of an earlier message with the same
+	// content received within the duplicate window
+	Fingerprint string
+	DuplicateOf string
+	// the raw message is kept in msgStore. Body is its decoded text, indexed
+	// but not stored.
+	Body        string
+	Attachments []attachment
+	// number and total decoded size of the attachments
+	AttachmentCount int
+	AttachmentSize  int
+	Delivered       time.Time
+	// time icemail received the message, and its size in bytes
+	Received   time.Time
+	Size       int
 	Recipients []string
+	// SMTP envelope sender, or nullSender for the null sender <>
+	Sender string
+	// IP address of the SMTP client which submitted the message
+	ClientIP string
+	Auth     authResults
+	Tags     []string
+	// seen, starred and labels, as set by users
+	State messageState
+	// comments left by users, oldest first. Kept in the index's internal
+	// storage like History.
+	Notes []note
+	// release attempts, oldest first. Also kept in the index's internal
+	// storage so it survives re-indexing.
+	History []releaseEvent
+	// ID of the message this is a delivery status notification for
+	BounceOf string
 }
 
 var index bleve.Index
 
+// nullSender is stored in place of an empty envelope sender
+const nullSender = "<>"
+
 // locationsBase is prepended to locations being filtered on
 const locationsBase = "Header."
 
@@ -49,11 +90,69 @@ func buildIndexMapping() mapping.IndexMapping {
 	headerMapping.AddFieldMappingsAt("Date", dateFieldMapping)
 
 	docMapping := bleve.NewDocumentMapping()
-	dataFieldMapping := bleve.NewTextFieldMapping()
-	dataFieldMapping.Index = false
-	docMapping.AddFieldMappingsAt("Data", dataFieldMapping)
+	bodyFieldMapping := bleve.NewTextFieldMapping()
+	bodyFieldMapping.Store = false
+	docMapping.AddFieldMappingsAt("Body", bodyFieldMapping)
 	docMapping.AddSubDocumentMapping("Header", headerMapping)
 
+	keywordFieldMapping := bleve.NewTextFieldMapping()
+	keywordFieldMapping.Analyzer = keyword.Name
+
+	authMapping := bleve.NewDocumentMapping()
+	for _, field := range []string{"DKIM", "DKIMDomains", "SPF", "ARC"} {
+		authMapping.AddFieldMappingsAt(field, keywordFieldMapping)
+	}
+	docMapping.AddSubDocumentMapping("Auth", authMapping)
+	docMapping.AddFieldMappingsAt("MessageID", keywordFieldMapping)
+	docMapping.AddFieldMappingsAt("References", keywordFieldMapping)
+	docMapping.AddFieldMappingsAt("ThreadSubject", keywordFieldMapping)
+	docMapping.AddFieldMappingsAt("ThreadID", keywordFieldMapping)
+	docMapping.AddFieldMappingsAt("Fingerprint", keywordFieldMapping)
+	docMapping.AddFieldMappingsAt("DuplicateOf", keywordFieldMapping)
+	docMapping.AddFieldMappingsAt("ClientIP", keywordFieldMapping)
+	docMapping.AddFieldMappingsAt("Sender", keywordFieldMapping)
+	docMapping.AddFieldMappingsAt("Tags", keywordFieldMapping)
+	docMapping.AddFieldMappingsAt("BounceOf", keywordFieldMapping)
+
+	attachmentMapping := bleve.NewDocumentMapping()
+	attachmentMapping.AddFieldMappingsAt("Filename", bleve.NewTextFieldMapping())
+	for _, field := range []string{"ContentType", "ContentID", "Disposition"} {
+		attachmentMapping.AddFieldMappingsAt(field, keywordFieldMapping)
+	}
+	attachmentMapping.AddFieldMappingsAt("Size", bleve.NewNumericFieldMapping())
+	docMapping.AddSubDocumentMapping("Attachments", attachmentMapping)
+
+	addressesMapping := bleve.NewDocumentMapping()
+	for _, header := range addressHeaders {
+		addressMapping := bleve.NewDocumentMapping()
+		for _, field := range []string{"Address", "Local", "Domain", "Name"} {
+			addressMapping.AddFieldMappingsAt(field, keywordFieldMapping)
+		}
+		addressesMapping.AddSubDocumentMapping(header, addressMapping)
+	}
+	docMapping.AddSubDocumentMapping("Addresses", addressesMapping)
+
+	stateMapping := bleve.NewDocumentMapping()
+	stateMapping.AddFieldMappingsAt("Seen", bleve.NewBooleanFieldMapping())
+	stateMapping.AddFieldMappingsAt("Starred", bleve.NewBooleanFieldMapping())
+	stateMapping.AddFieldMappingsAt("Labels", keywordFieldMapping)
+	docMapping.AddSubDocumentMapping("State", stateMapping)
+
+	notesMapping := bleve.NewDocumentMapping()
+	notesMapping.AddFieldMappingsAt("Text", bleve.NewTextFieldMapping())
+	notesMapping.AddFieldMappingsAt("Author", keywordFieldMapping)
+	notesMapping.AddFieldMappingsAt("Time", bleve.NewDateTimeFieldMapping())
+	docMapping.AddSubDocumentMapping("Notes", notesMapping)
+
+	historyMapping := bleve.NewDocumentMapping()
+	for _, field := range []string{"Actor", "RemoteAddr", "Recipients", "Transport"} {
+		historyMapping.AddFieldMappingsAt(field, keywordFieldMapping)
+	}
+	historyMapping.AddFieldMappingsAt("Response", bleve.NewTextFieldMapping())
+	historyMapping.AddFieldMappingsAt("Success", bleve.NewBooleanFieldMapping())
+	historyMapping.AddFieldMappingsAt("Time", bleve.NewDateTimeFieldMapping())
+	docMapping.AddSubDocumentMapping("History", historyMapping)
+
 	mapping.AddDocumentMapping("message", docMapping)
 	mapping.TypeField = "Type"
 
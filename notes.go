@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// prefix of the index internal keys holding notes
+const notesKeyPrefix = "notes/"
+
+// search location matching the text of notes
+const notesLocation = "Notes"
+
+// notesMu serialises changes to notes
+var notesMu sync.Mutex
+
+type NotesHandler struct{}
+
+// NoteRequest adds a note to a message
+type NoteRequest struct {
+	Text string
+}
+
+type NotesResult struct {
+	ID    string
+	Notes []note
+}
+
+// note is a comment left on a message by a user
+type note struct {
+	Time   time.Time
+	Author string
+	Text   string
+}
+
+func notesKey(docID string) []byte {
+	return []byte(notesKeyPrefix + docID)
+}
+
+// loadNotes returns the notes on a message, oldest first
+func loadNotes(docID string) ([]note, error) {
+	notes := make([]note, 0)
+	b, err := index.GetInternal(notesKey(docID))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return notes, nil
+	}
+	if err = json.Unmarshal(b, &notes); err != nil {
+		return nil, fmt.Errorf("error reading notes of mail with ID %s: %s", docID, err)
+	}
+	return notes, nil
+}
+
+// addNote adds a note to a message and re-indexes it so the note is
+// searchable
+func addNote(docID string, n note) ([]note, int, error) {
+	unlock := lockDoc(docID)
+	defer unlock()
+
+	doc, httpStatus, err := getDoc(docID)
+	if err != nil {
+		return nil, httpStatus, err
+	}
+	previous := doc.Notes
+	doc.Notes = append(append(make([]note, 0, len(previous)+1), previous...), n)
+	if err = saveNotes(docID, doc.Notes); err != nil {
+		return nil, 500, err
+	}
+	if err = index.Index(docID, doc); err != nil {
+		// put back the notes the index still has
+		saveNotes(docID, previous)
+		return nil, 500, err
+	}
+	log.Printf("Added note to mail ID %s by '%s'\n", docID, n.Author)
+	return doc.Notes, 200, nil
+}
+
+func saveNotes(docID string, notes []note) error {
+	notesMu.Lock()
+	defer notesMu.Unlock()
+	if len(notes) == 0 {
+		return index.DeleteInternal(notesKey(docID))
+	}
+	b, err := json.Marshal(notes)
+	if err != nil {
+		return err
+	}
+	return index.SetInternal(notesKey(docID), b)
+}
+
+func deleteNotes(docID string) error {
+	notesMu.Lock()
+	defer notesMu.Unlock()
+	return index.DeleteInternal(notesKey(docID))
+}
+
+// NotesHandler lists the notes on a message on GET, and adds one on POST.
+// The author is the user identified by requestActor.
+func (h *NotesHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	docID := mux.Vars(req)["docID"]
+	result := NotesResult{ID: docID}
+
+	if req.Method == http.MethodPost {
+		// read the request body
+		requestBody, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error reading request body: %v", err), 400)
+			return
+		}
+
+		// parse the request
+		var noteRequest NoteRequest
+		err = json.Unmarshal(requestBody, &noteRequest)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error parsing request: %v", err), 400)
+			return
+		}
+		text := strings.TrimSpace(noteRequest.Text)
+		if text == "" {
+			http.Error(w, "note requires a Text", 400)
+			return
+		}
+
+		n := note{Time: time.Now(), Author: requestActor(req).Name, Text: text}
+		var httpStatus int
+		if result.Notes, httpStatus, err = addNote(docID, n); err != nil {
+			http.Error(w, fmt.Sprintf("%s", err), httpStatus)
+			return
+		}
+		mustEncode(w, result)
+		return
+	}
+
+	doc, err := index.Document(docID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), 500)
+		return
+	}
+	if doc == nil {
+		http.Error(w, fmt.Sprintf("mail with ID %s not found", docID), 404)
+		return
+	}
+	if result.Notes, err = loadNotes(docID); err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), 500)
+		return
+	}
+
+	mustEncode(w, result)
+}
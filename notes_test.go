@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const noteEmailStr = `Date: Tue, 04 Apr 2017 19:02:05 +1000
+From: from@example.com
+To: to@example.com
+Subject: needs review
+Content-Type: text/plain; charset=us-ascii
+
+test message`
+
+func TestNotes(t *testing.T) {
+	defer purge("notes@example.com")
+	router := mux.NewRouter()
+	router.Handle("/api/messages/{docID}/notes", &NotesHandler{}).Methods("GET", "POST")
+	router.Handle("/api/search/{docID}", &SearchDocHandler{}).Methods("GET")
+
+	do := func(method, url, body string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	count := func(request SearchRequest) int {
+		bQuery, err := buildQuery(request)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		docs, err := matchingDocs(bQuery)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return len(docs)
+	}
+
+	if err := handleMessage(nil, "from@example.com", []string{"notes@example.com"}, []byte(noteEmailStr)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	docs, err := retainedDocs()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var id string
+	for _, doc := range docs {
+		if len(doc.Recipients) == 1 && doc.Recipients[0] == "notes@example.com" {
+			id = doc.ID
+		}
+	}
+
+	w := do("POST", "/api/messages/"+id+"/notes", `{"Text": "checked with zxq9vendor, OK to release"}`, http.Header{remoteUserHeader: {"alice"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	if w = do("POST", "/api/messages/"+id+"/notes", `{"Text": "  "}`, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("expected an empty note to return 400, got %d", w.Code)
+	}
+	if w = do("POST", "/api/messages/missing/notes", `{"Text": "note"}`, nil); w.Code != http.StatusNotFound {
+		t.Errorf("expected a note on a missing message to return 404, got %d", w.Code)
+	}
+
+	w = do("GET", "/api/search/"+id, "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	var result SearchResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(result.Emails) != 1 || len(result.Emails[0].Notes) != 1 {
+		t.Fatalf("expected one message with one note, got %s", w.Body.String())
+	}
+	if n := result.Emails[0].Notes[0]; n.Author != "alice" || n.Time.IsZero() {
+		t.Errorf("unexpected note %+v", n)
+	}
+
+	if n := count(SearchRequest{Query: "zxq9vendor", Locations: []string{notesLocation}}); n != 1 {
+		t.Errorf("expected the note text to match 1 message, got %d", n)
+	}
+	if n := count(SearchRequest{Query: "zxq9vendor"}); n != 1 {
+		t.Errorf("expected the note text to match 1 message in all fields, got %d", n)
+	}
+	if n := count(SearchRequest{NoteAuthor: "alice"}); n != 1 {
+		t.Errorf("expected 1 message with a note by alice, got %d", n)
+	}
+
+	// notes survive other updates
+	if _, err := tagDoc(id, "noted"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n := count(SearchRequest{Query: "zxq9vendor", Locations: []string{notesLocation}}); n != 1 {
+		t.Errorf("expected the note to be searchable after tagging, got %d", n)
+	}
+}
+
+func TestNotesWithState(t *testing.T) {
+	defer purge("notes-state@example.com")
+	if err := handleMessage(nil, "from@example.com", []string{"notes-state@example.com"}, []byte(noteEmailStr)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	docs, err := retainedDocs()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var id string
+	for _, doc := range docs {
+		if len(doc.Recipients) == 1 && doc.Recipients[0] == "notes-state@example.com" {
+			id = doc.ID
+		}
+	}
+
+	// notes and labels added together are all kept
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			if _, _, err := addNote(id, note{Time: time.Now(), Author: "test", Text: fmt.Sprintf("note %d", i)}); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := setState(id, StateRequest{AddLabels: []string{fmt.Sprintf("label-%d", i)}}); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	doc, _, err := getDoc(id)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(doc.Notes) != 8 || len(doc.State.Labels) != 8 {
+		t.Errorf("expected 8 notes and 8 labels, got %d and %v", len(doc.Notes), doc.State.Labels)
+	}
+}
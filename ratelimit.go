@@ -0,0 +1,237 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var outboundLimiter *deliveryLimiter
+
+// how often idle buckets are dropped
+const bucketPruneInterval = time.Minute
+
+type QueueHandler struct{}
+
+type QueueResult struct {
+	Pending int
+	Entries []queueEntry
+}
+
+// deliveryLimiter applies token bucket rate limits to outbound mail. Senders
+// block in Wait until every bucket the message draws from has a token.
+type deliveryLimiter struct {
+	mu sync.Mutex
+
+	conf    rateLimitConfig
+	global  *tokenBucket
+	domains map[string]*tokenBucket
+	relays  map[string]*tokenBucket
+
+	nextID uint64
+	queue  map[uint64]*queueEntry
+
+	pruned time.Time
+	// replaced in tests
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// queueEntry describes a delivery waiting on the rate limits
+type queueEntry struct {
+	Relay      string
+	From       string
+	Recipients []string
+	Queued     time.Time
+}
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newDeliveryLimiter(conf rateLimitConfig) *deliveryLimiter {
+	l := &deliveryLimiter{
+		conf:    conf,
+		domains: make(map[string]*tokenBucket),
+		relays:  make(map[string]*tokenBucket),
+		queue:   make(map[uint64]*queueEntry),
+		now:     time.Now,
+		sleep:   time.Sleep,
+	}
+	l.global = newTokenBucket(conf.Global, l.now())
+	l.pruned = l.now()
+	return l
+}
+
+// newTokenBucket returns a full bucket, or nil if the rate is unlimited
+func newTokenBucket(conf rateConfig, now time.Time) *tokenBucket {
+	if conf.Rate <= 0 {
+		return nil
+	}
+	burst := float64(conf.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: conf.Rate, burst: burst, tokens: burst, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// delay returns how long until a token will be available
+func (b *tokenBucket) delay() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// buckets returns the buckets a delivery draws from. Must be called with the
+// lock held.
+func (l *deliveryLimiter) buckets(relay string, rcpts []string, now time.Time) []*tokenBucket {
+	buckets := make([]*tokenBucket, 0)
+	if l.global != nil {
+		buckets = append(buckets, l.global)
+	}
+
+	b, ok := l.relays[relay]
+	if !ok {
+		conf, ok := l.conf.Relays[relay]
+		if !ok {
+			conf = l.conf.PerRelay
+		}
+		b = newTokenBucket(conf, now)
+		l.relays[relay] = b
+	}
+	if b != nil {
+		buckets = append(buckets, b)
+	}
+
+	seen := make(map[string]bool)
+	for _, rcpt := range rcpts {
+		domain := strings.ToLower(addressDomain(rcpt))
+		if seen[domain] {
+			continue
+		}
+		seen[domain] = true
+		b, ok := l.domains[domain]
+		if !ok {
+			conf, ok := l.conf.Domains[domain]
+			if !ok {
+				conf = l.conf.PerDomain
+			}
+			b = newTokenBucket(conf, now)
+			l.domains[domain] = b
+		}
+		if b != nil {
+			buckets = append(buckets, b)
+		}
+	}
+
+	return buckets
+}
+
+// prune drops the relay and domain buckets which have refilled, as they
+// are the same as new ones. Must be called with the lock held.
+func (l *deliveryLimiter) prune(now time.Time) {
+	for _, m := range []map[string]*tokenBucket{l.relays, l.domains} {
+		for key, b := range m {
+			if b != nil {
+				b.refill(now)
+			}
+			if b == nil || b.tokens >= b.burst {
+				delete(m, key)
+			}
+		}
+	}
+	l.pruned = now
+}
+
+// Wait blocks until the delivery is allowed by the global, relay and
+// recipient domain limits. A nil limiter never blocks.
+func (l *deliveryLimiter) Wait(relay, from string, rcpts []string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	var id uint64
+	var entry *queueEntry
+	for {
+		now := l.now()
+		if now.Sub(l.pruned) >= bucketPruneInterval {
+			l.prune(now)
+		}
+		buckets := l.buckets(relay, rcpts, now)
+		var delay time.Duration
+		for _, b := range buckets {
+			b.refill(now)
+			if d := b.delay(); d > delay {
+				delay = d
+			}
+		}
+
+		if delay == 0 {
+			for _, b := range buckets {
+				b.tokens--
+			}
+			if entry != nil {
+				delete(l.queue, id)
+			}
+			l.mu.Unlock()
+			if entry != nil {
+				log.Printf("Rate limited mail to %s delayed %s\n", rcpts, now.Sub(entry.Queued).Round(time.Millisecond))
+			}
+			return
+		}
+
+		if entry == nil {
+			l.nextID++
+			id = l.nextID
+			entry = &queueEntry{Relay: relay, From: from, Recipients: rcpts, Queued: now}
+			l.queue[id] = entry
+		}
+
+		l.mu.Unlock()
+		l.sleep(delay)
+		l.mu.Lock()
+	}
+}
+
+// Queue returns the deliveries currently waiting, oldest first
+func (l *deliveryLimiter) Queue() []queueEntry {
+	entries := make([]queueEntry, 0)
+	if l == nil {
+		return entries
+	}
+
+	l.mu.Lock()
+	for _, e := range l.queue {
+		entries = append(entries, *e)
+	}
+	l.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Queued.Before(entries[j].Queued)
+	})
+	return entries
+}
+
+func (h *QueueHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var result QueueResult
+	result.Entries = outboundLimiter.Queue()
+	result.Pending = len(result.Entries)
+
+	mustEncode(w, result)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeliveryLimiter(t *testing.T) {
+	l := newDeliveryLimiter(rateLimitConfig{
+		PerDomain: rateConfig{Rate: 20, Burst: 1},
+	})
+	clock := time.Date(2017, 4, 4, 19, 2, 5, 0, time.UTC)
+	var slept time.Duration
+	queued := 0
+	l.now = func() time.Time { return clock }
+	l.pruned = clock
+	l.sleep = func(d time.Duration) {
+		queued = len(l.Queue())
+		slept += d
+		clock = clock.Add(d)
+	}
+
+	l.Wait("relay", "from@example.com", []string{"a@example.com"})
+	l.Wait("relay", "from@example.com", []string{"b@example.org"})
+	if slept != 0 {
+		t.Errorf("different domains should not wait on each other, waited %s", slept)
+	}
+
+	l.Wait("relay", "from@example.com", []string{"c@example.com"})
+	if slept != 50*time.Millisecond {
+		t.Errorf("expected second delivery to example.com to wait 50ms, waited %s", slept)
+	}
+	if queued != 1 {
+		t.Errorf("expected 1 queued delivery while waiting, got %d", queued)
+	}
+	if n := len(l.Queue()); n != 0 {
+		t.Errorf("expected empty queue, got %d", n)
+	}
+
+	// idle buckets are dropped once refilled
+	clock = clock.Add(bucketPruneInterval)
+	l.Wait("relay", "from@example.com", []string{"d@example.net"})
+	if len(l.domains) != 1 || l.domains["example.net"] == nil {
+		t.Errorf("expected only the example.net bucket to be kept, got %v", l.domains)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/blevesearch/bleve"
+)
+
+// schemaVersion is incremented whenever buildIndexMapping or the fields of
+// bleveDoc change in a way that needs existing indexes rebuilt. Indexes from
+// before versioning are version 0.
+const schemaVersion = 7
+
+// index internal key holding the schema version
+var schemaVersionKey = []byte("schema/version")
+
+// prefixes of the index internal keys holding per-message data, which must be
+// carried over when the index is rebuilt
+var docInternalPrefixes = []string{historyKeyPrefix, notesKeyPrefix, stateKeyPrefix}
+
+// indexSchema returns the schema version of an index
+func indexSchema(idx bleve.Index) (int, error) {
+	b, err := idx.GetInternal(schemaVersionKey)
+	if err != nil {
+		return 0, err
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+	return strconv.Atoi(string(b))
+}
+
+func setIndexSchema(idx bleve.Index, version int) error {
+	return idx.SetInternal(schemaVersionKey, []byte(strconv.Itoa(version)))
+}
+
+// checkSchema reports whether the open index needs rebuilding. An index
+// created by a newer version of icemail is an error.
+func checkSchema() (bool, error) {
+	version, err := indexSchema(index)
+	if err != nil {
+		return false, fmt.Errorf("error reading schema version: %s", err)
+	}
+	if version > schemaVersion {
+		return false, fmt.Errorf("index schema version %d is newer than this version of %s supports (%d)", version, appName, schemaVersion)
+	}
+	return version < schemaVersion, nil
+}
+
+// reindexCommand rebuilds the index at indexDir from the message store,
+// replacing the existing index once the new one is complete. icemail must
+// not be running.
+func reindexCommand(indexDir string) error {
+	var err error
+	// the message store is locked while icemail is running
+	if msgStore, err = openStore(config.Storage, storeDir()); err != nil {
+		return fmt.Errorf("error opening message store: %s", err)
+	}
+	defer msgStore.Close()
+
+	if index, err = bleve.Open(indexDir); err != nil {
+		return fmt.Errorf("error opening index '%s': %s", indexDir, err)
+	}
+	// older indexes hold the raw messages needed to rebuild
+	if _, err = migrateData(); err != nil {
+		index.Close()
+		return fmt.Errorf("error moving messages out of index '%s': %s", indexDir, err)
+	}
+
+	newDir := indexDir + ".reindex"
+	if err = os.RemoveAll(newDir); err != nil {
+		index.Close()
+		return err
+	}
+	newIndex, err := bleve.New(newDir, buildIndexMapping())
+	if err != nil {
+		index.Close()
+		return fmt.Errorf("error creating index '%s': %s", newDir, err)
+	}
+
+	count, skipped, err := reindex(newIndex)
+	index.Close()
+	if err == nil {
+		err = setIndexSchema(newIndex, schemaVersion)
+	}
+	if err == nil {
+		err = newIndex.SetInternal(dataMigratedKey, []byte("1"))
+	}
+	if closeErr := newIndex.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.RemoveAll(newDir)
+		return fmt.Errorf("error rebuilding index: %s", err)
+	}
+
+	if err = swapPaths([]string{indexDir}, []string{newDir}); err != nil {
+		return err
+	}
+	fmt.Printf("Reindexed %d messages into '%s'\n", count, indexDir)
+	if skipped > 0 {
+		fmt.Printf("Skipped %d messages missing from the message store\n", skipped)
+	}
+	return nil
+}
+
+// reindex copies every message in the index into newIndex, re-deriving the
+// searchable fields from the raw message. It returns the number of messages
+// copied and the number skipped because the raw message was missing.
+func reindex(newIndex bleve.Index) (int, int, error) {
+	count, skipped := 0, 0
+	for offset := 0; ; offset += bulkPageSize {
+		bRequest := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), bulkPageSize, offset, false)
+		bRequest.SortBy([]string{"_id"})
+
+		searchResult, err := index.Search(bRequest)
+		if err != nil {
+			return count, skipped, fmt.Errorf("error executing query: %v", err)
+		}
+
+		batch := newIndex.NewBatch()
+		for _, hit := range searchResult.Hits {
+			doc, httpStatus, err := getDoc(hit.ID)
+			if httpStatus == 404 {
+				log.Printf("Skipping mail ID %s: %s\n", hit.ID, err)
+				skipped++
+				continue
+			}
+			if err != nil {
+				return count, skipped, fmt.Errorf("error loading mail ID %s: %s", hit.ID, err)
+			}
+			if err = batch.Index(hit.ID, doc); err != nil {
+				return count, skipped, err
+			}
+			for _, prefix := range docInternalPrefixes {
+				key := []byte(prefix + hit.ID)
+				v, err := index.GetInternal(key)
+				if err != nil {
+					return count, skipped, err
+				}
+				if len(v) > 0 {
+					batch.SetInternal(key, v)
+				}
+			}
+			count++
+		}
+		if err = newIndex.Batch(batch); err != nil {
+			return count, skipped, err
+		}
+
+		if len(searchResult.Hits) < bulkPageSize {
+			break
+		}
+	}
+	return count, skipped, nil
+}
+
+// swapPaths replaces each index or store in paths with the one at the same
+// position in newPaths. Every old copy is moved aside before any new one is
+// moved in, and the old copies are only deleted once all the new ones are in
+// place. On failure the old ones are restored.
+func swapPaths(paths, newPaths []string) error {
+	suffix := fmt.Sprintf(".old-%d", time.Now().Unix())
+	oldPaths := make([]string, len(paths))
+
+	// restore puts back the old copies, after moving the first n new copies
+	// back out of the way
+	restore := func(n int, err error) error {
+		for i := n - 1; i >= 0; i-- {
+			os.Rename(paths[i], newPaths[i])
+		}
+		for i, oldPath := range oldPaths {
+			if oldPath == "" {
+				continue
+			}
+			if restoreErr := os.Rename(oldPath, paths[i]); restoreErr != nil {
+				return fmt.Errorf("%s. The old copy of '%s' is at '%s'", err, paths[i], oldPath)
+			}
+		}
+		return err
+	}
+
+	for i, path := range paths {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			continue
+		}
+		oldPath := path + suffix
+		if err := os.Rename(path, oldPath); err != nil {
+			return restore(0, fmt.Errorf("error moving '%s' aside: %s", path, err))
+		}
+		oldPaths[i] = oldPath
+	}
+	for i, path := range paths {
+		if err := os.Rename(newPaths[i], path); err != nil {
+			return restore(i, fmt.Errorf("error moving '%s' into place: %s", newPaths[i], err))
+		}
+	}
+
+	for _, oldPath := range oldPaths {
+		if oldPath == "" {
+			continue
+		}
+		if err := os.RemoveAll(oldPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
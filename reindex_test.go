@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+)
+
+func TestReindex(t *testing.T) {
+	dir, err := ioutil.TempDir("", appName)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	savedIndex, savedStore, savedConfig := index, msgStore, config
+	defer func() { index, msgStore, config = savedIndex, savedStore, savedConfig }()
+	config.StorageDir = dir
+	config.Storage = fileStorage
+
+	// an unversioned index whose mapping doesn't index Body
+	indexDir := filepath.Join(dir, appName+".db")
+	oldMapping := bleve.NewIndexMapping()
+	oldMapping.TypeField = "Type"
+	if index, err = bleve.New(indexDir, oldMapping); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if msgStore, err = openStore(config.Storage, storeDir()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	msg, err := mail.ReadMessage(strings.NewReader(multipartStr))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	doc := bleveDoc{Type: "message", Header: msg.Header, Recipients: []string{"to@example.com"}, Tags: []string{"kept"}}
+	if err = msgStore.Put("1", []byte(multipartStr)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err = index.Index("1", doc); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err = appendHistory("1", releaseEvent{Actor: "test"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if stale, err := checkSchema(); err != nil || !stale {
+		t.Errorf("expected unversioned index to be stale, got %v (%v)", stale, err)
+	}
+	index.Close()
+	msgStore.Close()
+
+	if err = reindexCommand(indexDir); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if msgStore, err = openStore(config.Storage, storeDir()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer msgStore.Close()
+	if index, err = bleve.Open(indexDir); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer index.Close()
+
+	if stale, err := checkSchema(); err != nil || stale {
+		t.Errorf("expected rebuilt index to be current, got %v (%v)", stale, err)
+	}
+	bQuery, err := buildQuery(SearchRequest{Query: "zxq7token", Locations: []string{bodyLocation}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	docs, err := matchingDocs(bQuery)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(docs) != 1 {
+		t.Fatalf("expected body to be searchable after reindex, got %d matches", len(docs))
+	}
+	rebuilt, _, err := getDoc("1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(rebuilt.Tags) != 1 || rebuilt.AttachmentCount != 1 || len(rebuilt.History) != 1 {
+		t.Errorf("expected tags, attachments and history after reindex, got %+v", rebuilt)
+	}
+	if matches, _ := filepath.Glob(indexDir + ".*"); len(matches) != 0 {
+		t.Errorf("expected temporary indexes to be removed, found %v", matches)
+	}
+}
+
+func TestSwapPaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", appName)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return path
+	}
+	check := func(path, expected string) {
+		b, err := ioutil.ReadFile(path)
+		if err != nil || string(b) != expected {
+			t.Errorf("expected '%s' to contain '%s', got '%s' (%v)", path, expected, b, err)
+		}
+	}
+	paths := []string{write("store", "old store"), write("index", "old index")}
+
+	// the second new copy is missing, so both old copies must survive
+	newPaths := []string{write("store.new", "new store"), filepath.Join(dir, "index.new")}
+	if err = swapPaths(paths, newPaths); err == nil {
+		t.Fatalf("expected swap to fail")
+	}
+	check(paths[0], "old store")
+	check(paths[1], "old index")
+	check(newPaths[0], "new store")
+
+	write("index.new", "new index")
+	if err = swapPaths(paths, newPaths); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	check(paths[0], "new store")
+	check(paths[1], "new index")
+	if files, _ := filepath.Glob(filepath.Join(dir, "*.old-*")); len(files) != 0 {
+		t.Errorf("expected old copies to be removed, got %v", files)
+	}
+}
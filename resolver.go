@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const dnsTimeout = 5 * time.Second
+
+var resolver dnsResolver = newNetResolver("")
+
+// dnsResolver is the subset of DNS lookups needed to verify message
+// authentication. Lookups of names that don't exist return an error for which
+// isNotFound is true.
+type dnsResolver interface {
+	LookupTXT(name string) ([]string, error)
+	LookupIP(name string) ([]net.IP, error)
+	LookupMX(name string) ([]*net.MX, error)
+}
+
+// netResolver performs real DNS lookups, optionally against a specific server
+type netResolver struct {
+	r *net.Resolver
+}
+
+// zoneResolver answers lookups from records loaded out of a zone file so
+// verification can run without network access
+type zoneResolver struct {
+	records map[string][]zoneRecord
+}
+
+type zoneRecord struct {
+	Type  string
+	Value string
+}
+
+func newResolver(server, zoneFile string) (dnsResolver, error) {
+	if zoneFile != "" {
+		return loadZoneFile(zoneFile)
+	}
+	return newNetResolver(server), nil
+}
+
+func newNetResolver(server string) *netResolver {
+	if server == "" {
+		return &netResolver{net.DefaultResolver}
+	}
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+	return &netResolver{r}
+}
+
+func (n *netResolver) LookupTXT(name string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	return n.r.LookupTXT(ctx, name)
+}
+
+func (n *netResolver) LookupIP(name string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	addrs, err := n.r.LookupIPAddr(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, a := range addrs {
+		ips = append(ips, a.IP)
+	}
+	return ips, nil
+}
+
+func (n *netResolver) LookupMX(name string) ([]*net.MX, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+	return n.r.LookupMX(ctx, name)
+}
+
+// loadZoneFile reads a subset of the RFC 1035 master file format: $ORIGIN,
+// $TTL, and TXT, A, AAAA and MX records. Parentheses may be used to continue a
+// record over several lines.
+func loadZoneFile(filename string) (*zoneResolver, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	z := &zoneResolver{records: make(map[string][]zoneRecord)}
+	origin := ""
+	lastName := ""
+
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	var pending []string
+	pendingBlank := false
+	depth := 0
+	for scanner.Scan() {
+		lineNum++
+		line := scanner.Text()
+		tokens, d, err := zoneTokens(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", filename, lineNum, err)
+		}
+		if depth == 0 {
+			pending = nil
+			pendingBlank = len(line) > 0 && (line[0] == ' ' || line[0] == '\t')
+		}
+		pending = append(pending, tokens...)
+		depth += d
+		if depth > 0 || len(pending) == 0 {
+			continue
+		}
+		if depth < 0 {
+			return nil, fmt.Errorf("%s:%d: unbalanced parentheses", filename, lineNum)
+		}
+
+		tokens = pending
+		switch strings.ToUpper(tokens[0]) {
+		case "$ORIGIN":
+			if len(tokens) != 2 {
+				return nil, fmt.Errorf("%s:%d: invalid $ORIGIN", filename, lineNum)
+			}
+			origin = strings.ToLower(strings.TrimSuffix(tokens[1], "."))
+			continue
+		case "$TTL":
+			continue
+		}
+
+		name := lastName
+		if !pendingBlank {
+			name = zoneName(tokens[0], origin)
+			tokens = tokens[1:]
+		}
+		lastName = name
+
+		// skip optional TTL and class
+		for len(tokens) > 0 {
+			if _, err := strconv.Atoi(tokens[0]); err == nil || strings.EqualFold(tokens[0], "IN") {
+				tokens = tokens[1:]
+				continue
+			}
+			break
+		}
+		if len(tokens) < 2 {
+			return nil, fmt.Errorf("%s:%d: incomplete record", filename, lineNum)
+		}
+
+		rtype := strings.ToUpper(tokens[0])
+		var value string
+		switch rtype {
+		case "TXT":
+			value = strings.Join(tokens[1:], "")
+		case "A", "AAAA":
+			if net.ParseIP(tokens[1]) == nil {
+				return nil, fmt.Errorf("%s:%d: invalid address '%s'", filename, lineNum, tokens[1])
+			}
+			value = tokens[1]
+		case "MX":
+			if len(tokens) != 3 {
+				return nil, fmt.Errorf("%s:%d: invalid MX record", filename, lineNum)
+			}
+			value = tokens[1] + " " + zoneName(tokens[2], origin)
+		default:
+			// other record types aren't needed for verification
+			continue
+		}
+		z.records[name] = append(z.records[name], zoneRecord{Type: rtype, Value: value})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return z, nil
+}
+
+// zoneTokens splits a zone file line into tokens, stripping comments and
+// quotes. The change in parenthesis depth is returned separately.
+func zoneTokens(line string) ([]string, int, error) {
+	tokens := make([]string, 0)
+	depth := 0
+	var cur strings.Builder
+	inToken, inQuote := false, false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case inQuote && c == '\\' && i+1 < len(line):
+			i++
+			cur.WriteByte(line[i])
+		case inQuote && c == '"':
+			inQuote = false
+		case inQuote:
+			cur.WriteByte(c)
+		case c == '"':
+			inQuote, inToken = true, true
+		case c == ';':
+			i = len(line)
+		case c == '(' || c == ')':
+			if c == '(' {
+				depth++
+			} else {
+				depth--
+			}
+			fallthrough
+		case c == ' ' || c == '\t':
+			if inToken {
+				tokens = append(tokens, cur.String())
+				cur.Reset()
+				inToken = false
+			}
+		default:
+			cur.WriteByte(c)
+			inToken = true
+		}
+	}
+	if inQuote {
+		return nil, 0, fmt.Errorf("unterminated quoted string")
+	}
+	if inToken {
+		tokens = append(tokens, cur.String())
+	}
+	return tokens, depth, nil
+}
+
+func zoneName(name, origin string) string {
+	name = strings.ToLower(name)
+	switch {
+	case name == "@":
+		return origin
+	case strings.HasSuffix(name, "."):
+		return strings.TrimSuffix(name, ".")
+	case origin == "":
+		return name
+	}
+	return name + "." + origin
+}
+
+func (z *zoneResolver) lookup(name, rtype string) ([]string, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	values := make([]string, 0)
+	for _, r := range z.records[name] {
+		if r.Type == rtype {
+			values = append(values, r.Value)
+		}
+	}
+	if len(values) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return values, nil
+}
+
+func (z *zoneResolver) LookupTXT(name string) ([]string, error) {
+	return z.lookup(name, "TXT")
+}
+
+func (z *zoneResolver) LookupIP(name string) ([]net.IP, error) {
+	ips := make([]net.IP, 0)
+	for _, rtype := range []string{"A", "AAAA"} {
+		values, _ := z.lookup(name, rtype)
+		for _, v := range values {
+			ips = append(ips, net.ParseIP(v))
+		}
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+func (z *zoneResolver) LookupMX(name string) ([]*net.MX, error) {
+	values, err := z.lookup(name, "MX")
+	if err != nil {
+		return nil, err
+	}
+	mxs := make([]*net.MX, 0, len(values))
+	for _, v := range values {
+		parts := strings.SplitN(v, " ", 2)
+		pref, err := strconv.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid MX preference for '%s': %s", name, err)
+		}
+		mxs = append(mxs, &net.MX{Host: parts[1] + ".", Pref: uint16(pref)})
+	}
+	return mxs, nil
+}
+
+// isNotFound reports whether a lookup error means the name or record doesn't
+// exist, as opposed to a temporary failure
+func isNotFound(err error) bool {
+	if dnsErr, ok := err.(*net.DNSError); ok {
+		return dnsErr.IsNotFound
+	}
+	return false
+}
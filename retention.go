@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/blevesearch/bleve"
+)
+
+// default time between janitor runs
+const retentionInterval = time.Hour
+
+// retainedDoc is the information needed to apply retention policies to a
+// message
+type retainedDoc struct {
+	ID         string
+	Received   time.Time
+	Size       int
+	Recipients []string
+	Delivered  bool
+}
+
+// retentionJanitor periodically deletes messages exceeding the retention
+// policies. It never returns.
+func retentionJanitor(conf retentionConfig) {
+	interval := conf.interval()
+	for {
+		count, size, err := runRetention(conf)
+		if err != nil {
+			log.Printf("Retention janitor error: %s\n", err)
+		} else if count > 0 {
+			log.Printf("Retention janitor deleted %d messages, reclaimed %d bytes\n", count, size)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (c retentionConfig) interval() time.Duration {
+	if c.Interval.Duration <= 0 {
+		return retentionInterval
+	}
+	return c.Interval.Duration
+}
+
+// runRetention deletes every message that exceeds the global policy or any of
+// the rule policies, returning the number deleted and their total size
+func runRetention(conf retentionConfig) (int, int, error) {
+	docs, err := retainedDocs()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// newest first, so limits on count and size keep the most recent mail
+	sort.Slice(docs, func(i, j int) bool {
+		return docs[i].Received.After(docs[j].Received)
+	})
+
+	expired := make(map[string]retainedDoc)
+	policies := append([]retentionPolicy{conf.retentionPolicy}, conf.Rules...)
+	now := time.Now()
+	for _, p := range policies {
+		for _, doc := range p.expired(docs, now) {
+			expired[doc.ID] = doc
+		}
+	}
+
+	count, size := 0, 0
+	for id, doc := range expired {
+		if _, err := deleteDoc(id); err != nil {
+			return count, size, fmt.Errorf("error deleting mail ID %s: %s", id, err)
+		}
+		count++
+		size += doc.Size
+	}
+	return count, size, nil
+}
+
+// retainedDocs loads every message in the index
+func retainedDocs() ([]retainedDoc, error) {
+	docs := make([]retainedDoc, 0)
+	for {
+		bRequest := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), bulkPageSize, len(docs), false)
+		bRequest.SortBy([]string{"_id"})
+		bRequest.Fields = []string{"Received", "Size", "Recipients", "Delivered", "Header.Date"}
+
+		searchResult, err := index.Search(bRequest)
+		if err != nil {
+			return nil, fmt.Errorf("error executing query: %v", err)
+		}
+		for _, hit := range searchResult.Hits {
+			doc := retainedDoc{
+				ID:         hit.ID,
+				Recipients: fieldStrings(hit.Fields["Recipients"]),
+				Delivered:  fieldString(hit.Fields["Delivered"]) != "",
+			}
+			if received, err := time.Parse(time.RFC3339, fieldString(hit.Fields["Received"])); err == nil && !received.IsZero() {
+				doc.Received = received
+			} else if nanos, err := strconv.ParseInt(hit.ID, 10, 64); err == nil {
+				// older documents have no Received field, but IDs are the
+				// time of receipt
+				doc.Received = time.Unix(0, nanos)
+			} else if date, err := time.Parse(time.RFC3339, fieldString(hit.Fields["Header.Date"])); err == nil {
+				doc.Received = date
+			}
+			if size, ok := hit.Fields["Size"].(float64); ok {
+				doc.Size = int(size)
+			} else if raw, _, _, err := getMessage(hit.ID); err == nil {
+				doc.Size = len(raw)
+			}
+			docs = append(docs, doc)
+		}
+		if len(searchResult.Hits) < bulkPageSize {
+			break
+		}
+	}
+	return docs, nil
+}
+
+// expired returns the documents in scope of the policy which exceed its
+// limits. docs must be sorted newest first.
+func (p retentionPolicy) expired(docs []retainedDoc, now time.Time) []retainedDoc {
+	expired := make([]retainedDoc, 0)
+	count, size := 0, 0
+	for _, doc := range docs {
+		if !p.applies(doc) {
+			continue
+		}
+		count++
+		size += doc.Size
+
+		switch {
+		// the age of a message with no received time or date is unknown
+		case p.MaxAge.Duration > 0 && !doc.Received.IsZero() && now.Sub(doc.Received) > p.MaxAge.Duration:
+		case p.MaxCount > 0 && count > p.MaxCount:
+		case p.MaxSize > 0 && size > p.MaxSize:
+		default:
+			continue
+		}
+		expired = append(expired, doc)
+	}
+	return expired
+}
+
+// applies reports whether a document is in the scope of the policy
+func (p retentionPolicy) applies(doc retainedDoc) bool {
+	switch p.State {
+	case "delivered":
+		if !doc.Delivered {
+			return false
+		}
+	case "held":
+		if doc.Delivered {
+			return false
+		}
+	}
+	if p.Mailbox == "" {
+		return true
+	}
+	for _, rcpt := range doc.Recipients {
+		if addressMatches(rcpt, []string{p.Mailbox}) {
+			return true
+		}
+	}
+	return false
+}
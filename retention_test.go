@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+const retentionConfigStr = `
+[retention]
+interval = "10m"
+max_age = "720h"
+
+[[retention.rules]]
+mailbox = "retention.example.com"
+state = "held"
+max_count = 2
+`
+
+func TestRetention(t *testing.T) {
+	var c tomlConfig
+	if _, err := toml.Decode(retentionConfigStr, &c); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if c.Retention.MaxAge.Duration != 720*time.Hour || c.Retention.interval() != 10*time.Minute {
+		t.Fatalf("unexpected retention config %+v", c.Retention)
+	}
+	if len(c.Retention.Rules) != 1 || c.Retention.Rules[0].MaxCount != 2 {
+		t.Fatalf("unexpected retention rules %+v", c.Retention.Rules)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(emailStr))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	now := time.Now()
+	received := []time.Time{
+		now.Add(-1000 * time.Hour),
+		now.Add(-3 * time.Hour),
+		now.Add(-2 * time.Hour),
+		now.Add(-1 * time.Hour),
+	}
+	ids := make([]string, 0)
+	for i, r := range received {
+		id := fmt.Sprintf("retention-%d", i)
+		doc := bleveDoc{Type: "message", Header: msg.Header, Received: r, Size: len(emailStr), Recipients: []string{"to@retention.example.com"}}
+		if err := index.Index(id, doc); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		ids = append(ids, id)
+	}
+
+	// no received time, so aged by the Date header or not at all
+	undated := mail.Header{"Subject": {"undated"}}
+	for id, header := range map[string]mail.Header{"retention-dated": msg.Header, "retention-undated": undated} {
+		doc := bleveDoc{Type: "message", Header: header, Size: len(emailStr), Recipients: []string{"to@undated.example.com"}}
+		if err := index.Index(id, doc); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	defer index.Delete("retention-undated")
+
+	count, size, err := runRetention(c.Retention)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// the oldest and the one dated 2017 exceed max_age, and the next is over
+	// the mailbox's count
+	if count != 3 || size != 3*len(emailStr) {
+		t.Errorf("expected 3 messages deleted, got %d (%d bytes)", count, size)
+	}
+	for id, deleted := range map[string]bool{"retention-dated": true, "retention-undated": false} {
+		doc, err := index.Document(id)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if (doc == nil) != deleted {
+			t.Errorf("unexpected retention of %s", id)
+		}
+	}
+	for i, id := range ids {
+		doc, err := index.Document(id)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if (doc == nil) != (i < 2) {
+			t.Errorf("unexpected retention of message %d", i)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/blevesearch/bleve/search/query"
+	"github.com/gorilla/mux"
+)
+
+// prefix of the index internal keys holding message state
+const stateKeyPrefix = "state/"
+
+// stateMu serialises changes to message state
+var stateMu sync.Mutex
+
+type StateHandler struct{}
+
+// messageState is the review state of a message, set by users rather than
+// derived from the message
+type messageState struct {
+	Seen    bool
+	Starred bool
+	Labels  []string
+}
+
+// StateRequest changes the state of a message. Fields left out are unchanged.
+type StateRequest struct {
+	Seen         *bool
+	Starred      *bool
+	AddLabels    []string
+	RemoveLabels []string
+}
+
+type StateResult struct {
+	ID string
+	messageState
+}
+
+// StateHandler returns the state of a message on GET, and changes it on
+// PATCH
+func (h *StateHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	docID := mux.Vars(req)["docID"]
+
+	if req.Method == http.MethodPatch {
+		// read the request body
+		requestBody, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error reading request body: %v", err), 400)
+			return
+		}
+
+		// parse the request
+		var stateRequest StateRequest
+		err = json.Unmarshal(requestBody, &stateRequest)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("error parsing request: %v", err), 400)
+			return
+		}
+
+		if httpStatus, err := setState(docID, stateRequest); err != nil {
+			http.Error(w, fmt.Sprintf("%s", err), httpStatus)
+			return
+		}
+	}
+
+	doc, httpStatus, err := getDoc(docID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), httpStatus)
+		return
+	}
+
+	mustEncode(w, StateResult{ID: docID, messageState: doc.State})
+}
+
+func stateKey(docID string) []byte {
+	return []byte(stateKeyPrefix + docID)
+}
+
+// loadState returns the state of a message. Messages whose state was only
+// indexed fall back to the stored fields.
+func loadState(docID string, fields map[string]interface{}) (messageState, error) {
+	var state messageState
+	b, err := index.GetInternal(stateKey(docID))
+	if err != nil {
+		return state, err
+	}
+	if len(b) == 0 {
+		return storedState(fields), nil
+	}
+	if err = json.Unmarshal(b, &state); err != nil {
+		return state, fmt.Errorf("error reading state of mail with ID %s: %s", docID, err)
+	}
+	return state, nil
+}
+
+// storedState reads the state of a message from its stored fields
+func storedState(fields map[string]interface{}) messageState {
+	seen, _ := fields["State.Seen"].(bool)
+	starred, _ := fields["State.Starred"].(bool)
+	return messageState{Seen: seen, Starred: starred, Labels: fieldStrings(fields["State.Labels"])}
+}
+
+func saveState(docID string, state messageState) error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return index.SetInternal(stateKey(docID), b)
+}
+
+func deleteState(docID string) error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	return index.DeleteInternal(stateKey(docID))
+}
+
+// setState applies a StateRequest to a message. Delivery and other fields
+// are left as they are. The state is saved like notes, and the message
+// re-indexed so it can be searched on.
+func setState(docID string, stateRequest StateRequest) (int, error) {
+	add, err := cleanLabels(stateRequest.AddLabels)
+	if err != nil {
+		return 400, err
+	}
+	remove, err := cleanLabels(stateRequest.RemoveLabels)
+	if err != nil {
+		return 400, err
+	}
+
+	unlock := lockDoc(docID)
+	defer unlock()
+
+	doc, httpStatus, err := getDoc(docID)
+	if err != nil {
+		return httpStatus, err
+	}
+	previous := doc.State
+	if stateRequest.Seen != nil {
+		doc.State.Seen = *stateRequest.Seen
+	}
+	if stateRequest.Starred != nil {
+		doc.State.Starred = *stateRequest.Starred
+	}
+	labels := make([]string, 0, len(doc.State.Labels)+len(add))
+	for _, label := range append(doc.State.Labels, add...) {
+		if !containsString(labels, label) && !containsString(remove, label) {
+			labels = append(labels, label)
+		}
+	}
+	doc.State.Labels = labels
+
+	if err = saveState(docID, doc.State); err != nil {
+		return 500, err
+	}
+	if err = index.Index(docID, doc); err != nil {
+		// put back the state the index still has
+		saveState(docID, previous)
+		return 500, err
+	}
+	return 200, nil
+}
+
+// cleanLabels trims whitespace from labels, rejecting empty ones
+func cleanLabels(labels []string) ([]string, error) {
+	cleaned := make([]string, 0, len(labels))
+	for _, label := range labels {
+		label = strings.TrimSpace(label)
+		if label == "" {
+			return nil, fmt.Errorf("labels can't be empty")
+		}
+		cleaned = append(cleaned, label)
+	}
+	return cleaned, nil
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// stateFlagQuery matches messages with a state flag, e.g. Seen, set or not
+// set. Messages indexed before the flag existed count as not set.
+func stateFlagQuery(field string, set bool) query.Query {
+	flagQuery := query.NewBoolFieldQuery(true)
+	flagQuery.SetField("State." + field)
+	if set {
+		return flagQuery
+	}
+	return query.NewBooleanQuery([]query.Query{query.NewMatchAllQuery()}, nil, []query.Query{flagQuery})
+}
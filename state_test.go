@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestState(t *testing.T) {
+	defer purge("state@example.com")
+	router := mux.NewRouter()
+	router.Handle("/api/messages/{docID}/state", &StateHandler{}).Methods("GET", "PATCH")
+
+	do := func(method, url, body string) StateResult {
+		req := httptest.NewRequest(method, url, bytes.NewBufferString(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+		}
+		var result StateResult
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return result
+	}
+	count := func(request SearchRequest) int {
+		request.Tags = []string{"state-test"}
+		bQuery, err := buildQuery(request)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		docs, err := matchingDocs(bQuery)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		return len(docs)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := handleMessage(nil, "from@example.com", []string{"state@example.com"}, []byte(emailStr)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	docs, err := retainedDocs()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var ids []string
+	for _, doc := range docs {
+		if len(doc.Recipients) == 1 && doc.Recipients[0] == "state@example.com" {
+			ids = append(ids, doc.ID)
+			tagDoc(doc.ID, "state-test")
+		}
+	}
+	if len(ids) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(ids))
+	}
+
+	delivered := time.Now().UTC().Truncate(time.Second)
+	updateDoc(ids[0], func(doc *bleveDoc) error {
+		doc.Delivered = delivered
+		return nil
+	})
+
+	if result := do("GET", "/api/messages/"+ids[0]+"/state", ""); result.Seen || result.Starred || len(result.Labels) != 0 {
+		t.Errorf("expected a new message to have no state, got %+v", result)
+	}
+
+	result := do("PATCH", "/api/messages/"+ids[0]+"/state", `{"Seen": true, "AddLabels": ["triaged", " urgent ", "triaged"]}`)
+	if !result.Seen || result.Starred || !reflect.DeepEqual(result.Labels, []string{"triaged", "urgent"}) {
+		t.Errorf("unexpected state %+v", result)
+	}
+	result = do("PATCH", "/api/messages/"+ids[0]+"/state", `{"Starred": true, "RemoveLabels": ["urgent"]}`)
+	if !result.Seen || !result.Starred || !reflect.DeepEqual(result.Labels, []string{"triaged"}) {
+		t.Errorf("unexpected state %+v", result)
+	}
+
+	doc, _, err := getDoc(ids[0])
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if !doc.Delivered.Equal(delivered) {
+		t.Errorf("expected Delivered %s to be kept, got %s", delivered, doc.Delivered)
+	}
+
+	yes, no := true, false
+	tests := []struct {
+		request SearchRequest
+		count   int
+	}{
+		{SearchRequest{}, 2},
+		{SearchRequest{Seen: &yes}, 1},
+		{SearchRequest{Seen: &no}, 1},
+		{SearchRequest{Starred: &yes, Seen: &yes}, 1},
+		{SearchRequest{Starred: &no, Seen: &yes}, 0},
+		{SearchRequest{Labels: []string{"triaged"}}, 1},
+		{SearchRequest{Labels: []string{"urgent"}}, 0},
+	}
+	for _, test := range tests {
+		if n := count(test.request); n != test.count {
+			t.Errorf("expected %d results for %+v, got %d", test.count, test.request, n)
+		}
+	}
+
+	req := httptest.NewRequest("PATCH", "/api/messages/"+ids[1]+"/state", bytes.NewBufferString(`{"AddLabels": [" "]}`))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected an empty label to return 400, got %d", w.Code)
+	}
+}
+
+func TestStateDuringRelease(t *testing.T) {
+	defer purge("state-release@example.com")
+	if err := handleMessage(nil, "from@example.com", []string{"state-release@example.com"}, []byte(emailStr)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	docs, err := retainedDocs()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var id string
+	for _, doc := range docs {
+		if len(doc.Recipients) == 1 && doc.Recipients[0] == "state-release@example.com" {
+			id = doc.ID
+		}
+	}
+
+	// a slow transport leaves time for the changes below to interleave
+	mailSender = &emailSender{send: func(addr string, a smtp.Auth, from string, to []string, msg []byte) (string, error) {
+		time.Sleep(20 * time.Millisecond)
+		return "250 OK", nil
+	}}
+	defer func() {
+		f, _ := mockSend(nil)
+		mailSender = &emailSender{send: f}
+	}()
+
+	// labels added while the message is released twice are all kept, and
+	// only one release goes out
+	labels := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	var wg sync.WaitGroup
+	released := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := sendMailDoc(id, releaseActor{Name: "test"})
+			released <- err
+		}()
+	}
+	for _, label := range labels {
+		wg.Add(1)
+		go func(label string) {
+			defer wg.Done()
+			if _, err := setState(id, StateRequest{AddLabels: []string{label}}); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}(label)
+	}
+	wg.Wait()
+	close(released)
+
+	failed := 0
+	for err := range released {
+		if err != nil {
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Errorf("expected one of two releases to fail, got %d failures", failed)
+	}
+	doc, _, err := getDoc(id)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if doc.Delivered.IsZero() || len(doc.History) != 1 {
+		t.Errorf("expected one delivery, got %+v", doc.History)
+	}
+	sort.Strings(doc.State.Labels)
+	if !reflect.DeepEqual(doc.State.Labels, labels) {
+		t.Errorf("expected labels %v, got %v", labels, doc.State.Labels)
+	}
+}
@@ -1,10 +1,19 @@
 $(function() {
-	const apiURL = '//localhost:8080/api';
+	const apiURL = '//localhost:8080/api/v1';
+
+	// message of an API error response
+	function apiError(xhr) {
+		if( xhr.responseJSON && 'Error' in xhr.responseJSON ) {
+			return xhr.responseJSON.Error;
+		}
+		return xhr.responseText;
+	}
 
 	const fields = [
 		"From",
 		"To",
-		"Subject"
+		"Subject",
+		"Body"
 	];
 
 	var store = {
@@ -74,30 +83,30 @@ $(function() {
 
 			sendMsg: function(id) {
 				var self = this;
-				$.get(apiURL + '/mail/' + id, function(data) {
+				$.post(apiURL + '/messages/' + id + '/release', function(data) {
 					if('Success' in data) {
 						if(data.Success) {
 							self.delivered = moment()
 						}
 					}
 				}).fail( function(xhr, ajaxOptions, thrownError) {
-					self.error = xhr.responseText;
+					self.error = apiError(xhr);
 				});
 			},
 
 			viewMsg: function() {
 				var self = this;
-				$.get(apiURL + '/search/' + this.$route.params.id, function(data) {
-					self.header = data.Emails[0].Header;
-					self.body = data.Emails[0].Body;
-					self.id = data.Emails[0].ID;
-					if( 'Delivered' in data.Emails[0] ) {
-						self.delivered = moment(data.Emails[0].Delivered);
+				$.get(apiURL + '/messages/' + this.$route.params.id, function(data) {
+					self.header = data.Header;
+					self.body = data.Body;
+					self.id = data.ID;
+					if( 'Delivered' in data ) {
+						self.delivered = moment(data.Delivered);
 					} else {
 						self.delivered = '';
 					}
 				}).fail( function(xhr, ajaxOptions, thrownError) {
-					self.error = xhr.responseText;
+					self.error = apiError(xhr);
 				});
 			}
 		}
@@ -215,7 +224,7 @@ $(function() {
 						self.result.pages = Math.ceil( data.Total / request.limit );
 					},
 					error: function (xhr, ajaxOptions, thrownError) {
-						self.result.error = xhr.responseText;
+						self.result.error = apiError(xhr);
 					}
 				});
 			}
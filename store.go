@@ -0,0 +1,339 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	boltStorage   = "bolt"
+	fileStorage   = "file"
+	memoryStorage = "memory"
+)
+
+// index internal key set once Data has been moved out of the index
+var dataMigratedKey = []byte("migrated/data")
+
+var errNotStored = errors.New("message not in store")
+
+// messageStore holds raw messages keyed by document ID. The index holds only
+// the searchable fields.
+type messageStore interface {
+	Get(id string) ([]byte, error)
+	Put(id string, data []byte) error
+	Delete(id string) error
+	Close() error
+}
+
+var msgStore messageStore
+
+// openStore opens the message store of the given kind under dir
+func openStore(kind, dir string) (messageStore, error) {
+	path, err := storePath(kind, dir)
+	if err != nil {
+		return nil, err
+	}
+	if kind == fileStorage {
+		return newFileStore(path)
+	}
+	return newBoltStore(path)
+}
+
+// storePath returns the file or directory holding a message store
+func storePath(kind, dir string) (string, error) {
+	switch kind {
+	case "", boltStorage:
+		return filepath.Join(dir, appName+".messages.db"), nil
+	case fileStorage:
+		return filepath.Join(dir, appName+".messages"), nil
+	}
+	return "", fmt.Errorf("unknown storage '%s'", kind)
+}
+
+// storeDir is the directory holding the message store
+func storeDir() string {
+	if config.StorageDir == "" {
+		return "."
+	}
+	return config.StorageDir
+}
+
+// boltStore keeps messages in a single BoltDB file
+type boltStore struct {
+	db *bolt.DB
+}
+
+func newBoltStore(path string) (*boltStore, error) {
+	// fail rather than wait if another process has the store open
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(messageBucket))
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) Get(id string) ([]byte, error) {
+	var data []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket([]byte(messageBucket)).Get([]byte(id))
+		if v == nil {
+			return errNotStored
+		}
+		// v is only valid for the life of the transaction
+		data = append([]byte(nil), v...)
+		return nil
+	})
+	return data, err
+}
+
+func (s *boltStore) Put(id string, data []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(messageBucket)).Put([]byte(id), data)
+	})
+}
+
+func (s *boltStore) Delete(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(messageBucket)).Delete([]byte(id))
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// fileStore keeps each message in its own file
+type fileStore struct {
+	dir string
+}
+
+func newFileStore(dir string) (*fileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &fileStore{dir: dir}, nil
+}
+
+func (s *fileStore) path(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || id == "." || id == ".." {
+		return "", fmt.Errorf("invalid message ID '%s'", id)
+	}
+	return filepath.Join(s.dir, id+".eml"), nil
+}
+
+func (s *fileStore) Get(id string) ([]byte, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, errNotStored
+	}
+	return data, err
+}
+
+func (s *fileStore) Put(id string, data []byte) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	// write then rename so readers never see a partial message
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *fileStore) Delete(id string) error {
+	path, err := s.path(id)
+	if err != nil {
+		return err
+	}
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *fileStore) Close() error {
+	return nil
+}
+
+// memStore keeps messages in memory, for environments which shouldn't write
+// to disk. Messages are lost when icemail exits.
+type memStore struct {
+	mu       sync.Mutex
+	messages map[string][]byte
+	// IDs in the order they were stored
+	order []string
+	size  int
+	// total size of the messages above which the oldest are evicted. Zero
+	// means unlimited.
+	maxSize int
+}
+
+func newMemStore(maxSize int) *memStore {
+	return &memStore{messages: make(map[string][]byte), maxSize: maxSize}
+}
+
+func (s *memStore) Get(id string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.messages[id]
+	if !ok {
+		return nil, errNotStored
+	}
+	return data, nil
+}
+
+func (s *memStore) Put(id string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.messages[id]; ok {
+		s.size -= len(old)
+	} else {
+		s.order = append(s.order, id)
+	}
+	s.messages[id] = append([]byte(nil), data...)
+	s.size += len(data)
+	return nil
+}
+
+func (s *memStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.messages[id]; ok {
+		s.size -= len(old)
+		delete(s.messages, id)
+		for i, orderID := range s.order {
+			if orderID == id {
+				s.order = append(s.order[:i], s.order[i+1:]...)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (s *memStore) Close() error {
+	return nil
+}
+
+// overLimit returns the oldest message not in skip if the store exceeds its
+// size cap. The newest message is never evicted.
+func (s *memStore) overLimit(skip map[string]bool) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxSize <= 0 || s.size <= s.maxSize {
+		return "", false
+	}
+	for _, id := range s.order[:len(s.order)-1] {
+		if !skip[id] {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// evictMessages deletes the oldest messages until a memory store is within
+// its size cap
+func evictMessages() error {
+	s, ok := msgStore.(*memStore)
+	if !ok {
+		return nil
+	}
+	// messages being updated or released, possibly by the caller, are left
+	// for a later eviction
+	locked := make(map[string]bool)
+	for {
+		id, over := s.overLimit(locked)
+		if !over {
+			return nil
+		}
+		unlock, ok := tryLockDoc(id)
+		if !ok {
+			locked[id] = true
+			continue
+		}
+		httpStatus, err := deleteLockedDoc(id)
+		unlock()
+		if httpStatus == 404 {
+			// not indexed, so only in the store
+			err = s.Delete(id)
+		}
+		if err != nil {
+			return fmt.Errorf("error evicting mail ID %s: %s", id, err)
+		}
+		log.Printf("Evicted mail ID %s to stay within memory_max_size\n", id)
+	}
+}
+
+// migrateData moves raw messages stored in the Data field of older indexes
+// into the message store, returning the number moved. It only does work the
+// first time it is run against an index.
+func migrateData() (int, error) {
+	done, err := index.GetInternal(dataMigratedKey)
+	if err != nil {
+		return 0, err
+	}
+	if len(done) > 0 {
+		return 0, nil
+	}
+
+	moved := 0
+	for offset := 0; ; offset += bulkPageSize {
+		bRequest := bleve.NewSearchRequestOptions(bleve.NewMatchAllQuery(), bulkPageSize, offset, false)
+		bRequest.SortBy([]string{"_id"})
+		bRequest.Fields = []string{"Data"}
+
+		searchResult, err := index.Search(bRequest)
+		if err != nil {
+			return moved, fmt.Errorf("error executing query: %v", err)
+		}
+		for _, hit := range searchResult.Hits {
+			raw, ok := hit.Fields["Data"].(string)
+			if !ok {
+				continue
+			}
+			if err = msgStore.Put(hit.ID, []byte(raw)); err != nil {
+				return moved, err
+			}
+			// re-indexing drops Data, as it is no longer part of bleveDoc
+			if _, err = updateDoc(hit.ID, func(*bleveDoc) error { return nil }); err != nil {
+				return moved, fmt.Errorf("error migrating mail ID %s: %s", hit.ID, err)
+			}
+			moved++
+		}
+		if len(searchResult.Hits) < bulkPageSize {
+			break
+		}
+	}
+
+	if err = index.SetInternal(dataMigratedKey, []byte("1")); err != nil {
+		return moved, err
+	}
+	if moved > 0 {
+		log.Printf("Moved %d messages from the index to the message store\n", moved)
+	}
+	return moved, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/mapping"
+)
+
+func TestMessageStores(t *testing.T) {
+	dir, err := ioutil.TempDir("", appName)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, kind := range []string{boltStorage, fileStorage} {
+		s, err := openStore(kind, dir)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", kind, err)
+		}
+
+		if _, err = s.Get("1"); err != errNotStored {
+			t.Errorf("%s: expected errNotStored, got %v", kind, err)
+		}
+		if err = s.Put("1", []byte(emailStr)); err != nil {
+			t.Fatalf("%s: unexpected error: %s", kind, err)
+		}
+		data, err := s.Get("1")
+		if err != nil || string(data) != emailStr {
+			t.Errorf("%s: expected stored message back, got '%s' (%v)", kind, data, err)
+		}
+		if err = s.Delete("1"); err != nil {
+			t.Errorf("%s: unexpected error: %s", kind, err)
+		}
+		if _, err = s.Get("1"); err != errNotStored {
+			t.Errorf("%s: expected errNotStored after delete, got %v", kind, err)
+		}
+		if err = s.Delete("1"); err != nil {
+			t.Errorf("%s: expected deleting a missing message to succeed, got %s", kind, err)
+		}
+		s.Close()
+	}
+
+	if _, err = openStore("paper", dir); err == nil {
+		t.Errorf("expected error for unknown storage")
+	}
+}
+
+func TestMigrateData(t *testing.T) {
+	// an index as created by older versions, with the raw message stored
+	oldMapping := buildIndexMapping().(*mapping.IndexMappingImpl)
+	dataMapping := bleve.NewTextFieldMapping()
+	dataMapping.Index = false
+	oldMapping.TypeMapping["message"].AddFieldMappingsAt("Data", dataMapping)
+
+	oldIndex, err := bleve.NewMemOnly(oldMapping)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	savedIndex := index
+	index = oldIndex
+	defer func() { index = savedIndex }()
+
+	if err = index.Index("old-1", map[string]interface{}{
+		"Type":       "message",
+		"Data":       emailStr,
+		"Recipients": []string{"to@example.com"},
+		"Tags":       []string{"kept"},
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	moved, err := migrateData()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if moved != 1 {
+		t.Errorf("expected 1 message moved, got %d", moved)
+	}
+
+	raw, _, _, err := getMessage("old-1")
+	if err != nil || raw != emailStr {
+		t.Errorf("expected message in store, got '%s' (%v)", raw, err)
+	}
+	doc, _, err := getDoc("old-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(doc.Tags) != 1 || doc.Tags[0] != "kept" {
+		t.Errorf("expected fields to survive migration, got %+v", doc)
+	}
+	stored, err := index.Document("old-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	for _, f := range stored.Fields {
+		if f.Name() == "Data" {
+			t.Errorf("expected Data to be removed from the index")
+		}
+	}
+
+	if moved, err = migrateData(); err != nil || moved != 0 {
+		t.Errorf("expected second migration to do nothing, got %d (%v)", moved, err)
+	}
+}
+
+func TestMemStoreEviction(t *testing.T) {
+	savedStore := msgStore
+	defer func() { msgStore = savedStore }()
+	// room for two copies of the test message
+	store := newMemStore(2*len(emailStr) + 1)
+	msgStore = store
+
+	for _, to := range []string{"mem1@example.com", "mem2@example.com", "mem3@example.com"} {
+		if err := handleMessage(nil, "from@example.com", []string{to}, []byte(emailStr)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	if len(store.messages) != 2 || store.size > store.maxSize {
+		t.Errorf("expected 2 messages within %d bytes, got %d using %d", store.maxSize, len(store.messages), store.size)
+	}
+	docs, err := retainedDocs()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	kept := make(map[string]bool)
+	for _, doc := range docs {
+		if _, err := store.Get(doc.ID); err == nil {
+			kept[doc.Recipients[0]] = true
+		} else if doc.Recipients[0] == "mem1@example.com" {
+			t.Errorf("expected oldest message to be evicted from the index")
+		}
+	}
+	if !kept["mem2@example.com"] || !kept["mem3@example.com"] {
+		t.Errorf("expected newest messages to be kept, got %v", kept)
+	}
+
+	purge("mem2@example.com")
+	purge("mem3@example.com")
+}
+
+func TestMemStoreDelete(t *testing.T) {
+	// unlimited, so nothing is evicted
+	store := newMemStore(0)
+	for i := 0; i < 3; i++ {
+		if err := store.Put("1", []byte(emailStr)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if err := store.Delete("1"); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if err := store.Put("2", []byte(emailStr)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := store.Put("2", []byte(emailStr)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(store.order) != 1 || store.order[0] != "2" || store.size != len(emailStr) {
+		t.Errorf("expected only message 2 to be tracked, got %v using %d bytes", store.order, store.size)
+	}
+}
+
+func TestMemStoreEvictionSkipsLocked(t *testing.T) {
+	savedStore := msgStore
+	defer func() { msgStore = savedStore }()
+	store := newMemStore(2*len(emailStr) + 1)
+	msgStore = store
+	defer purge("evict.example.com")
+
+	for _, to := range []string{"a@evict.example.com", "b@evict.example.com"} {
+		if err := handleMessage(nil, "from@example.com", []string{to}, []byte(emailStr)); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	oldest := store.order[0]
+	unlock := lockDoc(oldest)
+	defer unlock()
+
+	// the oldest is being updated, so the next oldest goes instead
+	if err := handleMessage(nil, "from@example.com", []string{"c@evict.example.com"}, []byte(emailStr)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := store.Get(oldest); err != nil {
+		t.Errorf("expected the locked message to be kept")
+	}
+	if len(store.messages) != 2 {
+		t.Errorf("expected 2 messages, got %d", len(store.messages))
+	}
+}
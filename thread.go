@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strings"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search/query"
+	"github.com/gorilla/mux"
+)
+
+// reply and forward prefixes, removed from subjects when threading
+var subjectPrefixRe = regexp.MustCompile(`(?i)^\s*((re|fwd?|aw|sv)(\[\d+\])?\s*:\s*)+`)
+
+var msgIDRe = regexp.MustCompile(`<([^<>\s]+)>`)
+
+type ThreadHandler struct{}
+
+// threadHit is a thread matched by a search
+type threadHit struct {
+	ThreadID string
+	// newest matching message
+	ID string
+	// number of matching messages in the thread
+	Count int
+}
+
+// messageReferences returns the Message-IDs a message replies to, its direct
+// parent first
+func messageReferences(header mail.Header) []string {
+	ids := msgIDRe.FindAllStringSubmatch(header.Get("In-Reply-To"), -1)
+	refs := msgIDRe.FindAllStringSubmatch(header.Get("References"), -1)
+	// References lists the oldest ancestor first
+	for i := len(refs) - 1; i >= 0; i-- {
+		ids = append(ids, refs[i])
+	}
+
+	references := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if !containsString(references, id[1]) {
+			references = append(references, id[1])
+		}
+	}
+	return references
+}
+
+// threadSubject returns a subject without reply and forward prefixes,
+// lowercased, and whether it had any
+func threadSubject(subject string) (string, bool) {
+	trimmed := subjectPrefixRe.ReplaceAllString(subject, "")
+	return strings.ToLower(strings.TrimSpace(trimmed)), trimmed != subject
+}
+
+// assignThread sets the thread of a new message. It joins the thread of a
+// message it refers to or of a reply to it which arrived first. Failing
+// that, a reply joins the most recent thread with the same subject. Any
+// other message starts a thread, identified by its ID.
+func assignThread(id string, doc *bleveDoc) error {
+	if doc.ThreadID != "" {
+		return nil
+	}
+
+	var queries []query.Query
+	if len(doc.References) > 0 {
+		refQueries := make([]query.Query, 0, len(doc.References))
+		for _, ref := range doc.References {
+			refQuery := query.NewTermQuery(ref)
+			refQuery.SetField("MessageID")
+			refQueries = append(refQueries, refQuery)
+		}
+		queries = append(queries, query.NewDisjunctionQuery(refQueries))
+	}
+	if doc.MessageID != "" {
+		replyQuery := query.NewTermQuery(doc.MessageID)
+		replyQuery.SetField("References")
+		queries = append(queries, replyQuery)
+	}
+	if _, reply := threadSubject(doc.Header.Get("Subject")); doc.ThreadSubject != "" && (reply || len(doc.References) > 0) {
+		subjectQuery := query.NewTermQuery(doc.ThreadSubject)
+		subjectQuery.SetField("ThreadSubject")
+		queries = append(queries, subjectQuery)
+	}
+
+	for _, q := range queries {
+		bRequest := bleve.NewSearchRequestOptions(q, 1, 0, false)
+		bRequest.SortBy([]string{"-Received"})
+		bRequest.Fields = []string{"ThreadID"}
+		searchResult, err := index.Search(bRequest)
+		if err != nil {
+			return fmt.Errorf("error executing query: %v", err)
+		}
+		if len(searchResult.Hits) > 0 {
+			hit := searchResult.Hits[0]
+			doc.ThreadID = hitThreadID(hit.ID, hit.Fields)
+			return nil
+		}
+	}
+	doc.ThreadID = id
+	return nil
+}
+
+// hitThreadID returns the thread of a message. Messages indexed before
+// threading are alone in a thread identified by their ID.
+func hitThreadID(docID string, fields map[string]interface{}) string {
+	if threadID := fieldString(fields["ThreadID"]); threadID != "" {
+		return threadID
+	}
+	return docID
+}
+
+// threadQuery matches the messages in a thread
+func threadQuery(threadID string) query.Query {
+	idQuery := query.NewTermQuery(threadID)
+	idQuery.SetField("ThreadID")
+	return query.NewDisjunctionQuery([]query.Query{idQuery, query.NewDocIDQuery([]string{threadID})})
+}
+
+// matchingThreads collapses the matches of a query into threads, newest
+// first
+func matchingThreads(bQuery query.Query) ([]threadHit, error) {
+	threads := make([]threadHit, 0)
+	seen := make(map[string]int)
+	for offset := 0; ; offset += bulkPageSize {
+		bRequest := bleve.NewSearchRequestOptions(bQuery, bulkPageSize, offset, false)
+		bRequest.SortBy([]string{"-Header.Date", "_id"})
+		bRequest.Fields = []string{"ThreadID"}
+
+		searchResult, err := index.Search(bRequest)
+		if err != nil {
+			return nil, fmt.Errorf("error executing query: %v", err)
+		}
+		for _, hit := range searchResult.Hits {
+			threadID := hitThreadID(hit.ID, hit.Fields)
+			if i, ok := seen[threadID]; ok {
+				threads[i].Count++
+				continue
+			}
+			seen[threadID] = len(threads)
+			threads = append(threads, threadHit{ThreadID: threadID, ID: hit.ID, Count: 1})
+		}
+		if len(searchResult.Hits) < bulkPageSize {
+			break
+		}
+	}
+	return threads, nil
+}
+
+// threadedSearch returns a page of threads matching a search, each
+// represented by its newest matching message
+func threadedSearch(searchRequest SearchRequest, bQuery query.Query, size int) (SearchResult, error) {
+	var result SearchResult
+	threads, err := matchingThreads(bQuery)
+	if err != nil {
+		return result, err
+	}
+
+	page := threads
+	if searchRequest.Offset < len(page) {
+		page = page[searchRequest.Offset:]
+	} else {
+		page = nil
+	}
+	if len(page) > size {
+		page = page[:size]
+	}
+
+	result.Emails = make([]Email, 0)
+	if len(page) > 0 {
+		ids := make([]string, 0, len(page))
+		counts := make(map[string]int)
+		for _, thread := range page {
+			ids = append(ids, thread.ID)
+			counts[thread.ID] = thread.Count
+		}
+		bRequest := bleve.NewSearchRequestOptions(query.NewDocIDQuery(ids), len(ids), 0, false)
+		bRequest.SortBy([]string{"-Header.Date", "_id"})
+		bRequest.Fields = []string{"*"}
+		if result, err = doSearch(SearchRequest{}, bRequest, false); err != nil {
+			return result, err
+		}
+		for i := range result.Emails {
+			result.Emails[i].ThreadCount = counts[result.Emails[i].ID]
+		}
+	}
+	result.Total = uint64(len(threads))
+	return result, nil
+}
+
+// ThreadHandler returns every message in a thread, oldest first
+func (h *ThreadHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	threadID := mux.Vars(req)["threadID"]
+
+	bSearchRequest := bleve.NewSearchRequestOptions(threadQuery(threadID), ResultLimit, 0, false)
+	bSearchRequest.SortBy([]string{"Header.Date", "_id"})
+	bSearchRequest.Fields = []string{"*"}
+
+	result, err := doSearch(SearchRequest{}, bSearchRequest, false)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("%s", err), 500)
+		return
+	}
+	if result.Total == 0 {
+		http.Error(w, fmt.Sprintf("thread with ID %s not found", threadID), 404)
+		return
+	}
+	mustEncode(w, result)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/blevesearch/bleve/search/query"
+	"github.com/gorilla/mux"
+)
+
+func threadMsg(msgID, subject, extra string) []byte {
+	return []byte(fmt.Sprintf("Message-ID: <%s>\r\nSubject: %s\r\nFrom: from@example.com\r\nTo: thread@example.com\r\n%sContent-Type: text/plain\r\n\r\nthread message\r\n", msgID, subject, extra))
+}
+
+func TestMessageReferences(t *testing.T) {
+	header := map[string][]string{
+		"In-Reply-To": {"<c@example.com>"},
+		"References":  {"<a@example.com> <b@example.com>\r\n <c@example.com>"},
+	}
+	expected := []string{"c@example.com", "b@example.com", "a@example.com"}
+	if refs := messageReferences(header); !reflect.DeepEqual(refs, expected) {
+		t.Errorf("expected %v, got %v", expected, refs)
+	}
+
+	tests := []struct {
+		subject, normalized string
+		reply               bool
+	}{
+		{"Build failed", "build failed", false},
+		{"Re: Build failed", "build failed", true},
+		{"RE: Fwd: re[2]: Build failed ", "build failed", true},
+		{"Regarding the build", "regarding the build", false},
+	}
+	for _, test := range tests {
+		if normalized, reply := threadSubject(test.subject); normalized != test.normalized || reply != test.reply {
+			t.Errorf("expected %q, %v for %q, got %q, %v", test.normalized, test.reply, test.subject, normalized, reply)
+		}
+	}
+}
+
+func TestThreads(t *testing.T) {
+	defer purge("thread@example.com")
+	router := mux.NewRouter()
+	router.Handle("/api/threads/{threadID}", &ThreadHandler{}).Methods("GET")
+	router.Handle("/api/search", &SearchHandler{}).Methods("POST")
+
+	messages := []struct {
+		name string
+		data []byte
+	}{
+		{"root", threadMsg("root@example.com", "Order 42 shipped", "")},
+		{"reply", threadMsg("reply@example.com", "Re: Order 42 shipped", "In-Reply-To: <root@example.com>\r\n")},
+		// arrives before the message it replies to
+		{"late-reply", threadMsg("late-reply@example.com", "Re: Quarterly report", "References: <late@example.com>\r\n")},
+		{"late", threadMsg("late@example.com", "Quarterly report", "")},
+		// no references, but a reply by subject
+		{"subject-reply", threadMsg("subject-reply@example.com", "RE: order 42 SHIPPED", "")},
+		// same subject without a reply prefix starts a new thread
+		{"unrelated", threadMsg("unrelated@example.com", "Quarterly report", "")},
+	}
+	threads := make(map[string]string)
+	for _, m := range messages {
+		if err := handleMessage(nil, "from@example.com", []string{"thread@example.com"}, m.data); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		id, err := messageIDDoc(m.name + "@example.com")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		doc, _, err := getDoc(id)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		threads[m.name] = doc.ThreadID
+	}
+
+	for _, name := range []string{"reply", "subject-reply"} {
+		if threads[name] != threads["root"] {
+			t.Errorf("expected %s to join the root thread", name)
+		}
+	}
+	if threads["late"] != threads["late-reply"] {
+		t.Error("expected a message to join the thread of an earlier reply")
+	}
+	if threads["unrelated"] == threads["late"] || threads["late"] == threads["root"] {
+		t.Errorf("unexpected shared thread: %v", threads)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/threads/"+threads["root"], nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d: %s", w.Code, w.Body.String())
+	}
+	var result SearchResult
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if result.Total != 3 {
+		t.Errorf("expected 3 messages in the thread, got %d", result.Total)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/api/threads/missing", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected a missing thread to return 404, got %d", w.Code)
+	}
+
+	bQuery, err := buildQuery(SearchRequest{Address: map[string]string{"To": "thread@example.com"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	threaded, err := threadedSearch(SearchRequest{}, bQuery, ResultLimit)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if threaded.Total != 3 || len(threaded.Emails) != 3 {
+		t.Fatalf("expected 3 threads, got %d with %d messages", threaded.Total, len(threaded.Emails))
+	}
+	counts := make(map[string]int)
+	for _, e := range threaded.Emails {
+		counts[e.ThreadID] = e.ThreadCount
+	}
+	if counts[threads["root"]] != 3 || counts[threads["late"]] != 2 || counts[threads["unrelated"]] != 1 {
+		t.Errorf("unexpected thread counts %v", counts)
+	}
+
+	paged, err := threadedSearch(SearchRequest{Offset: 2}, bQuery, 2)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if paged.Total != 3 || len(paged.Emails) != 1 {
+		t.Errorf("expected the last of 3 threads, got %d with %d messages", paged.Total, len(paged.Emails))
+	}
+}
+
+// messageIDDoc returns the ID of the message with a Message-ID
+func messageIDDoc(msgID string) (string, error) {
+	idQuery := query.NewTermQuery(msgID)
+	idQuery.SetField("MessageID")
+	docs, err := matchingDocs(idQuery)
+	if err != nil {
+		return "", err
+	}
+	if len(docs) != 1 {
+		return "", fmt.Errorf("expected 1 message with Message-ID %s, got %d", msgID, len(docs))
+	}
+	return docs[0].ID, nil
+}
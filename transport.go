@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// name of the transport built from the smtp_server_* settings
+const smtpTransportName = "smtp"
+
+const webhookTimeout = 30 * time.Second
+
+// default time a command transport may run
+const commandTimeout = time.Minute
+
+var (
+	transports     map[string]EmailSender
+	transportRules []transportRuleConfig
+	// name of the transport used when no rule matches
+	defaultTransport = smtpTransportName
+)
+
+// httpTransport POSTs messages to a URL, either as raw message/rfc822 or as a
+// JSON document
+type httpTransport struct {
+	url     string
+	format  string
+	headers map[string]string
+	client  *http.Client
+}
+
+// fileTransport writes each message to a .eml file in a directory
+type fileTransport struct {
+	dir string
+}
+
+// commandTransport pipes each message into the stdin of an external command
+type commandTransport struct {
+	command []string
+	timeout time.Duration
+}
+
+// webhookError is returned for non-2xx webhook responses
+type webhookError struct {
+	StatusCode int
+	Status     string
+	Body       string
+}
+
+// webhookMessage is the JSON representation sent by httpTransport
+type webhookMessage struct {
+	From       string
+	Recipients []string
+	Header     mail.Header
+	Body       string
+	Raw        string
+}
+
+// loadTransports builds the transports named in config. The SMTP sender,
+// mailSender, is always available as "smtp".
+func loadTransports(confs []transportConfig) (map[string]EmailSender, error) {
+	t := make(map[string]EmailSender)
+	for _, c := range confs {
+		if c.Name == "" {
+			return nil, fmt.Errorf("transport requires a name")
+		}
+		if _, ok := t[c.Name]; ok || c.Name == smtpTransportName {
+			return nil, fmt.Errorf("duplicate transport name '%s'", c.Name)
+		}
+		sender, err := newTransport(c)
+		if err != nil {
+			return nil, fmt.Errorf("transport '%s': %s", c.Name, err)
+		}
+		t[c.Name] = sender
+	}
+	return t, nil
+}
+
+func newTransport(c transportConfig) (EmailSender, error) {
+	switch c.Type {
+	case "http":
+		if c.URL == "" {
+			return nil, fmt.Errorf("http transport requires a url")
+		}
+		format := c.Format
+		if format == "" {
+			format = "raw"
+		}
+		if format != "raw" && format != "json" {
+			return nil, fmt.Errorf("unknown format '%s'", format)
+		}
+		return &httpTransport{url: c.URL, format: format, headers: c.Headers, client: &http.Client{Timeout: webhookTimeout}}, nil
+	case "file":
+		if c.Dir == "" {
+			return nil, fmt.Errorf("file transport requires a dir")
+		}
+		if err := os.MkdirAll(c.Dir, 0755); err != nil {
+			return nil, err
+		}
+		return &fileTransport{dir: c.Dir}, nil
+	case "command":
+		if len(c.Command) == 0 {
+			return nil, fmt.Errorf("command transport requires a command")
+		}
+		timeout := c.Timeout.Duration
+		if timeout <= 0 {
+			timeout = commandTimeout
+		}
+		return &commandTransport{command: c.Command, timeout: timeout}, nil
+	}
+	return nil, fmt.Errorf("unknown transport type '%s'", c.Type)
+}
+
+// checkTransports makes sure the default transport and those used by rules
+// exist
+func checkTransports() error {
+	names := []string{defaultTransport}
+	for _, rule := range transportRules {
+		names = append(names, rule.Transport)
+	}
+	for _, name := range names {
+		if _, ok := transports[name]; !ok && name != smtpTransportName {
+			return fmt.Errorf("unknown transport '%s'", name)
+		}
+	}
+	return nil
+}
+
+// selectTransport returns the transport for a message: the first rule matching
+// the sender or any recipient, otherwise the default
+func selectTransport(from string, rcpts []string) (string, EmailSender, error) {
+	name := defaultTransport
+	for _, rule := range transportRules {
+		if rule.matches(from, rcpts) {
+			name = rule.Transport
+			break
+		}
+	}
+	if name == smtpTransportName {
+		return name, mailSender, nil
+	}
+	sender, ok := transports[name]
+	if !ok {
+		return name, nil, fmt.Errorf("unknown transport '%s'", name)
+	}
+	return name, sender, nil
+}
+
+// matches reports whether the rule applies. Entries are addresses or domains,
+// in the same form as the whitelist.
+func (r transportRuleConfig) matches(from string, rcpts []string) bool {
+	if len(r.From) > 0 {
+		if a, err := mail.ParseAddress(from); err == nil {
+			from = a.Address
+		}
+		if !addressMatches(from, r.From) {
+			return false
+		}
+	}
+	if len(r.Recipients) == 0 {
+		return true
+	}
+	for _, rcpt := range rcpts {
+		if addressMatches(rcpt, r.Recipients) {
+			return true
+		}
+	}
+	return false
+}
+
+// addressMatches reports whether address equals one of the given addresses
+// or belongs to one of the given domains
+func addressMatches(address string, list []string) bool {
+	for _, w := range list {
+		if strings.Contains(w, "@") {
+			if strings.EqualFold(w, address) {
+				return true
+			}
+		} else if strings.EqualFold(w, addressDomain(address)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Send returns the HTTP status of the response
+func (t *httpTransport) Send(to []string, from string, body []byte) (string, error) {
+	var payload []byte
+	contentType := "message/rfc822"
+	if t.format == "json" {
+		msg, err := mail.ReadMessage(bytes.NewReader(body))
+		if err != nil {
+			return "", err
+		}
+		m := webhookMessage{From: from, Recipients: to, Header: msg.Header, Raw: string(body)}
+		m.Body = parseContent(msg).Text
+		if payload, err = json.Marshal(m); err != nil {
+			return "", err
+		}
+		contentType = "application/json"
+	} else {
+		payload = body
+	}
+
+	req, err := http.NewRequest("POST", t.url, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Envelope-From", from)
+	req.Header.Set("X-Envelope-To", strings.Join(to, ", "))
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return "", &webhookError{resp.StatusCode, resp.Status, strings.TrimSpace(string(b))}
+	}
+	return resp.Status, nil
+}
+
+func (e *webhookError) Error() string {
+	return fmt.Sprintf("webhook returned %s: %s", e.Status, e.Body)
+}
+
+// Permanent treats client errors as permanent, other than timeouts and rate
+// limiting
+func (e *webhookError) Permanent() bool {
+	return e.StatusCode >= 400 && e.StatusCode <= 499 && e.StatusCode != 408 && e.StatusCode != 429
+}
+
+// Send returns the name of the file written
+func (t *fileTransport) Send(to []string, from string, body []byte) (string, error) {
+	// write to a temp file first so readers never see a partial message
+	tmp, err := ioutil.TempFile(t.dir, ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	// the temp file's random suffix keeps concurrent releases from
+	// overwriting each other
+	suffix := strings.TrimPrefix(filepath.Base(tmp.Name()), ".tmp-")
+	name := filepath.Join(t.dir, fmt.Sprintf("%v-%s.eml", time.Now().UnixNano(), suffix))
+	if _, err = tmp.Write(body); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err = os.Rename(tmp.Name(), name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// Send runs the command with the message on stdin. Arguments "{from}" and
+// "{to}" are replaced by the envelope sender and recipients. The command's
+// output is returned.
+func (t *commandTransport) Send(to []string, from string, body []byte) (string, error) {
+	// an address starting with "-" would be read as an option
+	for _, addr := range append([]string{from}, to...) {
+		if strings.HasPrefix(addr, "-") {
+			return "", fmt.Errorf("refusing to pass address '%s' to command '%s'", addr, t.command[0])
+		}
+	}
+
+	args := make([]string, 0, len(t.command))
+	for _, a := range t.command[1:] {
+		switch a {
+		case "{from}":
+			args = append(args, from)
+		case "{to}":
+			args = append(args, to...)
+		default:
+			args = append(args, a)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), t.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, t.command[0], args...)
+	cmd.Stdin = bytes.NewReader(body)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("command '%s' timed out after %s", t.command[0], t.timeout)
+		}
+		return "", fmt.Errorf("command '%s' failed: %s: %s", t.command[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestTransports(t *testing.T) {
+	dir, err := ioutil.TempDir("", appName)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	confs := []transportConfig{
+		{Name: "drop", Type: "file", Dir: filepath.Join(dir, "drop")},
+		{Name: "pipe", Type: "command", Command: []string{"sh", "-c", "cat > " + filepath.Join(dir, "piped.eml")}},
+	}
+	if transports, err = loadTransports(confs); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	transportRules = []transportRuleConfig{
+		{Recipients: []string{"example.org"}, Transport: "drop"},
+		{From: []string{"pipe@example.com"}, Transport: "pipe"},
+	}
+	defer func() {
+		transports = nil
+		transportRules = nil
+	}()
+
+	tests := []struct {
+		from      string
+		rcpts     []string
+		transport string
+	}{
+		{"from@example.com", []string{"to@example.com"}, smtpTransportName},
+		{"from@example.com", []string{"to@example.com", "to@example.org"}, "drop"},
+		{"Pipe <pipe@example.com>", []string{"to@example.com"}, "pipe"},
+	}
+	for i, test := range tests {
+		name, sender, err := selectTransport(test.from, test.rcpts)
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %s", i, err)
+		}
+		if name != test.transport {
+			t.Errorf("test %d: expected transport '%s', got '%s'", i, test.transport, name)
+		}
+		if _, err = sender.Send(test.rcpts, test.from, []byte(emailStr)); err != nil {
+			t.Errorf("test %d: unexpected error: %s", i, err)
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "drop", "*.eml"))
+	if err != nil || len(files) != 1 {
+		t.Errorf("expected 1 file in drop dir, got %d (%v)", len(files), err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(dir, "piped.eml"))
+	if err != nil || string(b) != emailStr {
+		t.Errorf("expected piped message, got %q (%v)", b, err)
+	}
+}
+
+func TestWebhookJSON(t *testing.T) {
+	var received webhookMessage
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := json.NewDecoder(req.Body).Decode(&received); err != nil {
+			http.Error(w, err.Error(), 400)
+		}
+	}))
+	defer server.Close()
+
+	sender, err := newTransport(transportConfig{Name: "webhook", Type: "http", URL: server.URL, Format: "json"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// emailStr has no Content-Type
+	if _, err = sender.Send([]string{"to@example.com"}, "from@example.com", []byte(emailStr)); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if received.Body != "test message" || received.Header.Get("Subject") != "test subject" {
+		t.Errorf("unexpected webhook message %+v", received)
+	}
+}
+
+func TestFileTransportConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", appName)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sender, err := newTransport(transportConfig{Name: "drop", Type: "file", Dir: dir})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := sender.Send([]string{"to@example.com"}, "from@example.com", []byte(emailStr)); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if files, err := filepath.Glob(filepath.Join(dir, "*.eml")); err != nil || len(files) != 20 {
+		t.Errorf("expected 20 files, got %d (%v)", len(files), err)
+	}
+}
+
+func TestCommandTransportChecks(t *testing.T) {
+	sender, err := newTransport(transportConfig{Name: "pipe", Type: "command", Command: []string{"cat"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err = sender.Send([]string{"-oQ/tmp/x@example.com"}, "from@example.com", []byte(emailStr)); err == nil {
+		t.Errorf("expected a recipient starting with '-' to be refused")
+	}
+	if _, err = sender.Send([]string{"to@example.com"}, "-fevil@example.com", []byte(emailStr)); err == nil {
+		t.Errorf("expected a sender starting with '-' to be refused")
+	}
+
+	var c tomlConfig
+	if _, err := toml.Decode("[[transports]]\nname = \"slow\"\ntype = \"command\"\ncommand = [\"sleep\", \"5\"]\ntimeout = \"50ms\"\n", &c); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if sender, err = newTransport(c.Transports[0]); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	start := time.Now()
+	if _, err = sender.Send([]string{"to@example.com"}, "from@example.com", []byte(emailStr)); err == nil {
+		t.Errorf("expected a hung command to time out")
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Errorf("expected the command to be killed after its timeout, took %s", time.Since(start))
+	}
+}